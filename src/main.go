@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/apooravm/tshare-client/src/receiver"
 	"github.com/apooravm/tshare-client/src/sender"
+	"github.com/apooravm/tshare-client/src/server"
 	"github.com/apooravm/tshare-client/src/shared"
 )
 
@@ -20,8 +27,40 @@ var (
 	pbIsMB      = true
 	pbOff       = false
 	client_name string
+	// Address the relay listens on with 'serve'
+	servePort = "4000"
+	// Port the relay also takes raw TCP connections on, none if empty
+	serveTCPPort string
+	// Words in the secret part of the transfer code
+	codeWordCount = shared.DefaultCodeWordCount
+	// Max chunks the sender may stream ahead of the receiver
+	window uint32 = receiver.DefaultWindow
+	// What the receiver does with files that already exist
+	onConflict = receiver.ConflictOverwrite
+	// Files to receive, all if empty
+	fileSelection string
+	// Apply the sender's file modes and mtimes and create empty folders
+	preserve = false
+	// What the sender does with symlinks in a folder
+	symlinks = shared.SymlinksFollow
+	// Codec offered or accepted for compressing chunks, see shared.CodecNames
+	compression = "gzip"
+	// When to send the files of a folder as one archive
+	archiveMode = sender.ArchiveAuto
+	// Globs of files in a folder to leave out or to only send
+	excludes []string
+	includes []string
+	// Transfer code for receive, asked for if empty
+	receiveCode string
+	// Accept the transfer without asking
+	autoAccept = false
+	// Write the received file to stdout, with '-o -'
+	receiveToStdout = false
+	// Send a text snippet instead of a path, with -text. '-' reads it from stdin
+	textToSend string
+	sendText   = false
 	// chunkSize   uint32 = 262144
-	chunkSize uint32 = 1000 * 1024
+	chunkSize uint32 = shared.DefaultChunkSize
 	// chunkSize uint32 = 128
 	// chunkSize    uint8 = 128
 	// chunkSize uint16 = 2048
@@ -30,6 +69,16 @@ var (
 	// chunkSize uint32 = 262144
 )
 
+// Exit code after Ctrl-C or SIGTERM, 128 + SIGINT like shells use.
+const exitInterrupted = 130
+
+// Exit code of a transfer that failed or did not finish, so scripts can tell it from a finished one.
+const exitFailed = 1
+
+// How long an interrupted transfer gets to abort before the process exits anyway,
+// for when it is stuck on a prompt or a write.
+const abortGracePeriod = 3 * time.Second
+
 func main() {
 	cli_args := os.Args[1:]
 	if len(cli_args) == 0 {
@@ -37,10 +86,37 @@ func main() {
 		return
 	}
 
-	handleArgs()
+	ctx := interruptContext()
+	handleArgs(ctx)
+	if ctx.Err() != nil {
+		os.Exit(exitInterrupted)
+	}
 }
 
-func handleArgs() {
+// Cancelled on Ctrl-C or SIGTERM, which aborts the running transfer.
+// A second signal exits right away.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		cancel()
+
+		select {
+		case <-signals:
+		case <-time.After(abortGracePeriod):
+		}
+
+		fmt.Fprintln(os.Stderr, "Interrupted.")
+		os.Exit(exitInterrupted)
+	}()
+
+	return ctx
+}
+
+func handleArgs(ctx context.Context) {
 	if len(os.Args) <= 1 {
 		fmt.Println("Invalid Argument \nTry 'tshare-client.exe send <path> | receive | help'")
 		return
@@ -54,6 +130,26 @@ func handleArgs() {
 	command := os.Args[1]
 	switch command {
 	case "send":
+		if client_name == "" {
+			client_name = "Sender"
+		}
+
+		if sendText {
+			if textToSend == "-" {
+				text, err := readStdinText()
+				if err != nil {
+					fmt.Println(err.Error())
+					return
+				}
+
+				textToSend = text
+			}
+
+			res, err := sender.HandleSendTextArg(ctx, textToSend, sendOptions(nil))
+			exitIfSendFailed(ctx, res, err)
+			return
+		}
+
 		if len(os.Args) <= 2 {
 			fmt.Println("No file provided. 'tshare-client.exe send <path/to/file>'")
 			return
@@ -61,17 +157,23 @@ func handleArgs() {
 
 		targetPath := os.Args[2]
 
+		// 'send -' streams stdin until EOF.
+		if targetPath == "-" {
+			fmt.Printf("Sending stdin. %d bytes per packet.\n", chunkSize)
+			opts := sendOptions(*shared.GetStdinFileInfo())
+			opts.Archive = sender.ArchiveOff
+			res, err := sender.HandleSendArg(ctx, opts)
+			exitIfSendFailed(ctx, res, err)
+			return
+		}
+
 		fileinfo, err := os.Stat(targetPath)
 		if err != nil {
 			log.Println("E:Getting fileinfo.", err.Error())
 			return
 		}
 
-		if client_name == "" {
-			client_name = "Sender"
-		}
-
-		allFileInfo, err := shared.GetAllFileInfo(targetPath)
+		allFileInfo, err := shared.GetAllFileInfo(targetPath, symlinks, shared.NewFileFilter(excludes, includes), shared.Output)
 		if err != nil {
 			fmt.Println(err.Error())
 			return
@@ -86,37 +188,104 @@ func handleArgs() {
 			fmt.Printf("Sending %s [%.2fMB]. %d bytes per packet.\n", fileinfo.Name(), float64(fileinfo.Size())/float64(1000_000), chunkSize)
 		}
 
-		sender.HandleSendArg(uint32(chunkSize), fileinfo.Size(), client_name, allFileInfo, pbType, pbRGBOn, pbIsMB, pbLength, pbOff)
+		res, err := sender.HandleSendArg(ctx, sendOptions(*allFileInfo))
+		exitIfSendFailed(ctx, res, err)
 
 	case "receive":
-		if len(os.Args) > 2 && os.Args[2][0] != '-' {
-			receivePath = os.Args[2]
+		// 'receive [code] [path]', in either order.
+		for _, arg := range os.Args[2:] {
+			if strings.HasPrefix(arg, "-") {
+				continue
+			}
+
+			if looksLikeCode(arg) {
+				receiveCode = arg
+				continue
+			}
+
+			// Most likely a mistyped code, which would otherwise be created as the receive folder.
+			if _, err := os.Stat(arg); os.IsNotExist(err) && hasNameplate(arg) {
+				_, _, err := shared.ParseCode(arg)
+				fmt.Printf("E:No such file or folder %s. %s\n", arg, err.Error())
+				return
+			}
+
+			receivePath = arg
 		}
 
-		handleFolderCreate()
+		if receiveCode == "" {
+			receiveCode = os.Getenv("TSHARE_CODE")
+		}
 
-		fileinfo, err := os.Stat(receivePath)
-		if err != nil {
-			fmt.Println("E:Getting pathinfo.", err.Error())
-			return
+		if isTruthy(os.Getenv("TSHARE_YES")) {
+			autoAccept = true
 		}
 
-		if !fileinfo.IsDir() {
-			fmt.Println("E:Target must be a folder.")
-			return
+		// With '-o -' the file goes to stdout. Everything printed goes to stderr instead so it does not mix with the file.
+		var stdoutSink *os.File
+		if receiveToStdout {
+			stdoutSink = os.Stdout
+			os.Stdout = os.Stderr
+			shared.Output = os.Stderr
+		} else {
+			handleFolderCreate()
+
+			fileinfo, err := os.Stat(receivePath)
+			if err != nil {
+				fmt.Println("E:Getting pathinfo.", err.Error())
+				return
+			}
+
+			if !fileinfo.IsDir() {
+				fmt.Println("E:Target must be a folder.")
+				return
+			}
 		}
 
 		if client_name == "" {
 			client_name = "Receiver"
 		}
 
-		receiver.HandleReceiveArg(client_name, receivePath, pbType, pbRGBOn, pbIsMB, pbLength, pbOff)
+		opts := receiver.Options{
+			Endpoint:    shared.Endpoint,
+			Output:      shared.Output,
+			Name:        client_name,
+			Dir:         receivePath,
+			Stdout:      stdoutSink,
+			Code:        receiveCode,
+			Accept:      autoAccept,
+			Window:      window,
+			OnConflict:  onConflict,
+			Select:      fileSelection,
+			Preserve:    preserve,
+			Codecs:      shared.OfferedCodecs(compression),
+			ProgressBar: progressBarOptions(),
+		}
+
+		res, err := receiver.HandleReceiveArg(ctx, opts)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+
+		if err != nil || !res.Finished || len(res.FailedVerification) > 0 {
+			os.Exit(exitFailed)
+		}
+
+	case "serve":
+		if err := server.HandleServeArg(":"+servePort, tcpAddr()); err != nil {
+			fmt.Println("E:Running relay.", err.Error())
+			return
+		}
 
 	case "help":
 		PrintHelp()
 
 	default:
-		fmt.Println("Invalid Argument \nTry 'tshare-client.exe send <path> | receive | help'")
+		fmt.Println("Invalid Argument \nTry 'tshare-client.exe send <path> | receive | serve | help'")
 		return
 	}
 }
@@ -125,13 +294,31 @@ func PrintHelp() {
 	fmt.Println("App usage: 'tshare-client.exe [COMMAND] [CMD_ARG] -[SUB_CMD]=[SUB_CMD_ARG]'")
 	fmt.Println("\nCommands -")
 	fmt.Println("Send - Send a file. Point to any file. 'tshare-client.exe send <path/to/file>'")
+	fmt.Println("  Or send a text snippet, which the receiver prints. '-' reads it from stdin. 'tshare-client.exe send -text \"some token\"'")
 	fmt.Println("Receive - Receive a file. Custom target folder can be assigned by passing it next. 'tshare-client.exe receive [CUST_RECV_PATH]")
+	fmt.Println("  The code can be passed too, to receive without prompts. 'tshare-client.exe receive 7-crossover-clockwork [CUST_RECV_PATH] -yes'")
+	fmt.Println("  Or set with the env vars TSHARE_CODE and TSHARE_YES=1.")
+	fmt.Println("  Pass '-' to send stdin, e.g. 'tar c dir | tshare-client.exe send -'. Write the received file to stdout with '-o -', e.g. 'tshare-client.exe receive -o - | tar x'")
+	fmt.Println("Serve - Run a self-hosted relay. 'tshare-client.exe serve -port=4000'")
 	fmt.Println("Help - Display this helper text. 'tshare-client.exe help")
 	fmt.Println("\nSubcommands - Attach these at the end")
 	fmt.Println("Set a custom chunk size. '-chunk=<CHUNK_SIZE>'")
 	fmt.Println("Set a custom chunk multiple. chunkSize -> (x * 1024) '-chunkm=<NUM>'")
 	fmt.Println("Set a custom client name. '-name=<NAME>'")
+	fmt.Println("Set the number of words in the transfer code. Default is 2. '-codewords=3'")
+	fmt.Printf("Set the max chunks the sender streams ahead when receiving. 1 requests every chunk. Default is %d. '-window=16'\n", receiver.DefaultWindow)
+	fmt.Println("Set what to do with received files that already exist. overwrite/skip/rename/ask. Default is overwrite. '-onconflict=rename'")
+	fmt.Println("Select the files to receive. Comma separated ids, ranges or globs. '-select=1,3-5,data/src/**/*.go'")
+	fmt.Println("Accept the transfer without asking. '-yes'")
+	fmt.Println("Set the codec chunks are compressed with, if both sides support it. Already compressed files are sent as is. gzip/none. Default is gzip. '-compress=none'")
+	fmt.Println("Set when the files of a folder are sent as one archive, saving a round trip per file. auto archives many small files. auto/on/off. Default is auto. '-archive=on'")
+	fmt.Println("Set what to do with symlinks in a folder being sent. skip/follow/preserve. Default is follow. '-symlinks=preserve'")
+	fmt.Println("Leave files out of a folder being sent, or only send some. Comma separated globs relative to the folder. .gitignore and .tshareignore files in it are honoured too. .git folders are left out unless included. '-exclude=node_modules,build/**' '-include=src/**/*.go,.git'")
+	fmt.Println("Keep the sender's file modes and modification times, and create empty folders. '-preserve'")
 	fmt.Println("Set to dev mode. '-mode=dev'")
+	fmt.Println("Connect to a custom relay. '-endpoint=ws://<host>:4000/api/share'")
+	fmt.Println("Set the port the relay listens on. Default is 4000. '-port=4000'")
+	fmt.Println("Also take raw TCP connections on this port when serving. Clients connect with '-endpoint=tcp://<host>:4001'. '-tcpport=4001'")
 	fmt.Println("Set progress bar type. all/single '-pbtype=single'")
 	fmt.Println("Set progress bar length. Default is 20. '-pblen=50'")
 	fmt.Println("Set progress bar rgb colouring. rgb/normal '-pbcolour=rgb'")
@@ -153,17 +340,127 @@ func handleFolderCreate() {
 	}
 }
 
+// Text for 'send -text -'. A single trailing newline, as left by echo, is dropped.
+func readStdinText() (string, error) {
+	text, err := io.ReadAll(io.LimitReader(os.Stdin, shared.MaxTextSize+1))
+	if err != nil {
+		return "", fmt.Errorf("E:Reading stdin. %s", err.Error())
+	}
+
+	return strings.TrimSuffix(string(text), "\n"), nil
+}
+
+// A positional arg is taken as a transfer code if it parses as one, with every word in the list,
+// unless a file or folder by that name exists.
+func looksLikeCode(arg string) bool {
+	if _, _, err := shared.ParseCode(arg); err != nil {
+		return false
+	}
+
+	_, err := os.Stat(arg)
+	return os.IsNotExist(err)
+}
+
+// Starts with a nameplate, like '7-', as a mistyped code does.
+func hasNameplate(arg string) bool {
+	nameplate, _, found := strings.Cut(arg, "-")
+	if !found {
+		return false
+	}
+
+	_, err := strconv.ParseUint(nameplate, 10, 16)
+	return err == nil
+}
+
+// Address for the relay's TCP listener, from -tcpport.
+func tcpAddr() string {
+	if serveTCPPort == "" {
+		return ""
+	}
+
+	return ":" + serveTCPPort
+}
+
+// Progress bar settings from the -pb flags.
+func progressBarOptions() shared.ProgressBarOptions {
+	return shared.ProgressBarOptions{Type: pbType, Length: pbLength, RGB: pbRGBOn, InMB: pbIsMB, Off: pbOff}
+}
+
+// Send settings from the flags, for files.
+func sendOptions(files []shared.FileInfo) sender.Options {
+	return sender.Options{
+		Endpoint:    shared.Endpoint,
+		Output:      shared.Output,
+		Name:        client_name,
+		Files:       files,
+		ChunkSize:   uint32(chunkSize),
+		CodeWords:   codeWordCount,
+		Codecs:      shared.OfferedCodecs(compression),
+		Archive:     archiveMode,
+		ProgressBar: progressBarOptions(),
+	}
+}
+
+// Print err and exit with exitFailed unless the send finished. An interrupted send is left to main.
+func exitIfSendFailed(ctx context.Context, res sender.Result, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+
+	if err != nil || !res.Finished {
+		os.Exit(exitFailed)
+	}
+}
+
+func isTruthy(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "y":
+		return true
+	}
+
+	return false
+}
+
 // Handle flags
 func handleFlags() error {
-	for _, arg := range os.Args[1:] {
-		if arg[0] != '-' {
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// A lone '-' is stdin/stdout, not a flag.
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
 			continue
 		}
 
 		// arg[1:] to remove the -
-		argParts := strings.Split(arg[1:], "=")
-		if len(argParts) != 2 {
-			return fmt.Errorf("Invalid flag format.")
+		argParts := strings.SplitN(arg[1:], "=", 2)
+
+		// Flags without a value.
+		if len(argParts) == 1 {
+			switch argParts[0] {
+			case "yes", "y":
+				autoAccept = true
+				continue
+
+			case "preserve":
+				preserve = true
+				continue
+
+			// '-o <path>' and '-text <text>' also take the next arg, for the usual '-o -'.
+			case "o", "text":
+				if i+1 == len(args) {
+					return fmt.Errorf("Missing value after -%s.", argParts[0])
+				}
+
+				i++
+				argParts = append(argParts, args[i])
+
+			default:
+				return fmt.Errorf("Invalid flag format.")
+			}
 		}
 
 		switch argParts[0] {
@@ -186,12 +483,105 @@ func handleFlags() error {
 		case "name":
 			client_name = argParts[1]
 
+		case "codewords":
+			count, err := strconv.ParseUint(argParts[1], 10, 8)
+			if err != nil || count == 0 || count > shared.MaxCodeWordCount {
+				return fmt.Errorf("Invalid code word count. Must be 1-%d.", shared.MaxCodeWordCount)
+			}
+
+			codeWordCount = int(count)
+
+		case "window":
+			size, err := strconv.ParseUint(argParts[1], 10, 32)
+			if err != nil || size == 0 {
+				return fmt.Errorf("Invalid window. Must be at least 1.")
+			}
+
+			window = uint32(size)
+
+		case "onconflict":
+			if !slices.Contains(receiver.ConflictPolicies, argParts[1]) {
+				return fmt.Errorf("Invalid conflict policy. Must be %s.", strings.Join(receiver.ConflictPolicies, "/"))
+			}
+
+			onConflict = argParts[1]
+
+		case "compress":
+			if _, ok := shared.CodecNames[argParts[1]]; !ok {
+				return fmt.Errorf("Invalid codec. Must be gzip/none.")
+			}
+
+			compression = argParts[1]
+
+		case "archive":
+			if !slices.Contains(sender.ArchiveModes, argParts[1]) {
+				return fmt.Errorf("Invalid archive mode. Must be %s.", strings.Join(sender.ArchiveModes, "/"))
+			}
+
+			archiveMode = argParts[1]
+
+		case "symlinks":
+			if !slices.Contains(shared.SymlinkPolicies, argParts[1]) {
+				return fmt.Errorf("Invalid symlink policy. Must be %s.", strings.Join(shared.SymlinkPolicies, "/"))
+			}
+
+			symlinks = argParts[1]
+
+		// Comma separated, and can be repeated.
+		case "exclude", "include":
+			for _, pattern := range strings.Split(argParts[1], ",") {
+				if pattern == "" {
+					continue
+				}
+
+				if !shared.ValidGlob(pattern) {
+					return fmt.Errorf("Invalid %s glob %q.", argParts[0], pattern)
+				}
+
+				if argParts[0] == "exclude" {
+					excludes = append(excludes, pattern)
+				} else {
+					includes = append(includes, pattern)
+				}
+			}
+
+		case "text":
+			sendText = true
+			textToSend = argParts[1]
+
+		case "o", "out":
+			if argParts[1] == "-" {
+				receiveToStdout = true
+			} else {
+				receivePath = argParts[1]
+			}
+
+		case "select":
+			fileSelection = argParts[1]
+
 		// Settint to devmode
 		case "mode":
 			if argParts[1] == "dev" {
 				shared.Endpoint = "ws://localhost:4000/api/share"
 			}
 
+		case "endpoint":
+			shared.Endpoint = argParts[1]
+
+		case "port":
+			if _, err := strconv.ParseUint(argParts[1], 10, 16); err != nil {
+				return fmt.Errorf("Invalid port.")
+			}
+
+			servePort = argParts[1]
+
+		case "tcpport":
+			if _, err := strconv.ParseUint(argParts[1], 10, 16); err != nil {
+				return fmt.Errorf("Invalid TCP port.")
+			}
+
+			serveTCPPort = argParts[1]
+
 		case "pbtype":
 			switch argParts[1] {
 			case "total":
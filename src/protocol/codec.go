@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/apooravm/tshare-client/src/shared"
+	"github.com/apooravm/tshare-client/src/transport"
+)
+
+// [Version 1byte][Type 1byte]
+const HeaderLen = 2
+
+// Returned when a frame cannot be decoded into a message.
+type DecodeError struct {
+	// Zero if the frame was too short to carry a type.
+	MessageType uint8
+	Reason      string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("E:Decoding message type 0x%02x. %s", e.MessageType, e.Reason)
+}
+
+func expectLen(m Message, payload []byte, n int) error {
+	if len(payload) != n {
+		return &DecodeError{MessageType: m.Type(), Reason: fmt.Sprintf("payload is %d bytes, expected %d.", len(payload), n)}
+	}
+
+	return nil
+}
+
+func expectMinLen(m Message, payload []byte, n int) error {
+	if len(payload) < n {
+		return &DecodeError{MessageType: m.Type(), Reason: fmt.Sprintf("payload is %d bytes, expected at least %d.", len(payload), n)}
+	}
+
+	return nil
+}
+
+// Get an empty message for the type byte. nil if the type is unknown.
+func newMessage(messageType uint8) Message {
+	switch messageType {
+	case shared.InitialTypeTransferCode:
+		return &TransferCode{}
+	case shared.InitialTypeReceiverMD:
+		return &ReceiverMD{}
+	case shared.InitialTypeManifestChunk:
+		return &ManifestChunk{}
+	case shared.InitialTypeManifestEnd:
+		return &ManifestEnd{}
+	case shared.InitialTypeManifestAck:
+		return &ManifestAck{}
+	case shared.InitialTypeStartTransferWithId:
+		return &StartTransferWithId{}
+	case shared.InitialTypeStartTransferWithIdAtOffset:
+		return &StartTransferWithIdAtOffset{}
+	case shared.InitialTypeSkipFile:
+		return &SkipFile{}
+	case shared.InitialTypeSelectFiles:
+		return &SelectFiles{}
+	case shared.InitialTypeUseCodec:
+		return &UseCodec{}
+	case shared.InitialTypeStartArchive:
+		return &StartArchive{}
+	case shared.InitialTypeReceiverDisconnected:
+		return &ReceiverDisconnected{}
+	case shared.InitialTypeGrantCredit:
+		return &GrantCredit{}
+	case shared.InitialTypeTransferPacket:
+		return &TransferPacket{}
+	case shared.InitialTypeSingleFileTransferFinish:
+		return &SingleFileTransferFinish{}
+	case shared.InitialTypeAllTransferFinish:
+		return &AllTransferFinish{}
+	case shared.InitialTypeAbortTransfer:
+		return &AbortTransfer{}
+	case shared.InitialAbortTransfer:
+		return &ReceiverAbort{}
+	case shared.InitialTypePakeMessage:
+		return &PakeMessage{}
+	case shared.InitialTypePakeConfirm:
+		return &PakeConfirm{}
+	case shared.InitialTypeTextMessage:
+		return &TextMessage{}
+	case shared.InitialTypeCloseConnNotify:
+		return &CloseConnNotify{}
+	case shared.InitialTypeCloseConn:
+		return &CloseConn{}
+	default:
+		return nil
+	}
+}
+
+// Encode the message into a frame.
+func Encode(m Message) ([]byte, error) {
+	payload, err := m.encodePayload()
+	if err != nil {
+		return nil, fmt.Errorf("E:Encoding message type 0x%02x. %s", m.Type(), err.Error())
+	}
+
+	frame := make([]byte, HeaderLen+len(payload))
+	frame[0] = shared.Version
+	frame[1] = m.Type()
+	copy(frame[HeaderLen:], payload)
+	return frame, nil
+}
+
+// Decode a frame into its message.
+// Returns a *DecodeError for short frames, unknown versions or types and invalid payloads.
+func Decode(frame []byte) (Message, error) {
+	if len(frame) < HeaderLen {
+		return nil, &DecodeError{Reason: fmt.Sprintf("frame is %d bytes, expected at least %d.", len(frame), HeaderLen)}
+	}
+
+	if frame[0] != shared.Version {
+		return nil, &DecodeError{MessageType: frame[1], Reason: fmt.Sprintf("unsupported version %d, expected %d.", frame[0], shared.Version)}
+	}
+
+	m := newMessage(frame[1])
+	if m == nil {
+		return nil, &DecodeError{MessageType: frame[1], Reason: "unknown message type."}
+	}
+
+	if err := m.decodePayload(frame[HeaderLen:]); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Encode the message and write it to conn as a single frame.
+func Write(conn transport.Transport, m Message) error {
+	frame, err := Encode(m)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteMessage(frame)
+}
+
+// Read the next frame from conn and decode it.
+// Connection errors are returned as is, malformed frames as *DecodeError.
+func Read(conn transport.Transport) (Message, error) {
+	frame, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	return Decode(frame)
+}
+
+func RequestCloseConn(conn transport.Transport) {
+	if err := Write(conn, &CloseConn{}); err != nil {
+		log.Println("E:Writing closure message to server. Quitting.")
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	"github.com/apooravm/tshare-client/src/secure"
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+// Max bytes of sealed manifest per ManifestChunk frame.
+const ManifestChunkSize = 256 * 1024
+
+// Max total size of a sealed manifest the relay stores.
+const MaxManifestSize = 64 * 1024 * 1024
+
+// Key of the manifest uploaded to the relay. Only sent to the receiver, sealed, after the key exchange.
+// The manifest is sealed before the transfer code exists, so it cannot use the code derived key.
+type ManifestKey struct {
+	Key []byte
+	// Chunks the manifest was split into. Catches a relay dropping the last chunks.
+	Chunks uint32
+
+	// shared.ContentKindFiles or shared.ContentKindText.
+	Kind uint8
+	// The snippet for ContentKindText. The manifest is empty then.
+	Text string `json:",omitempty"`
+	// Codecs the sender can compress transfer packets with, preferred first. The receiver picks one with UseCodec.
+	Codecs []uint8 `json:",omitempty"`
+	// The files are sent as one tar stream, requested with StartArchive instead of one by one.
+	Archive bool `json:",omitempty"`
+}
+
+// Seal the json encoded file metadata under a new random key and split it into chunks.
+func SealManifest(files []shared.FileInfo) (*ManifestKey, []*ManifestChunk, error) {
+	metadata, err := json.Marshal(files)
+	if err != nil {
+		return nil, nil, fmt.Errorf("E:Encoding metadata. %s", err.Error())
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, fmt.Errorf("E:Generating manifest key. %s", err.Error())
+	}
+
+	manifestChannel, err := secure.NewChannel(key, secure.RoleSender)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var chunks []*ManifestChunk
+	for start := 0; start < len(metadata); start += ManifestChunkSize {
+		end := min(start+ManifestChunkSize, len(metadata))
+		chunks = append(chunks, &ManifestChunk{Sealed: manifestChannel.Seal(metadata[start:end])})
+	}
+
+	return &ManifestKey{Key: key, Chunks: uint32(len(chunks))}, chunks, nil
+}
+
+// Open the manifest chunks, in the order they were uploaded.
+func OpenManifest(key *ManifestKey, chunks []*ManifestChunk) ([]shared.FileInfo, error) {
+	if uint32(len(chunks)) != key.Chunks {
+		return nil, fmt.Errorf("E:Incomplete manifest. Got %d of %d chunks.", len(chunks), key.Chunks)
+	}
+
+	manifestChannel, err := secure.NewChannel(key.Key, secure.RoleReceiver)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata []byte
+	for _, chunk := range chunks {
+		part, err := manifestChannel.Open(chunk.Sealed)
+		if err != nil {
+			return nil, err
+		}
+
+		metadata = append(metadata, part...)
+	}
+
+	var files []shared.FileInfo
+	if err := json.Unmarshal(metadata, &files); err != nil {
+		return nil, &DecodeError{MessageType: shared.InitialTypeReceiverMD, Reason: "invalid metadata. " + err.Error()}
+	}
+
+	return files, nil
+}
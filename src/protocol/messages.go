@@ -0,0 +1,484 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/apooravm/tshare-client/src/secure"
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+// Every frame is [Version 1byte][Type 1byte][payload...].
+// Each message type below owns the layout of its payload.
+type Message interface {
+	Type() uint8
+	encodePayload() ([]byte, error)
+	decodePayload(payload []byte) error
+}
+
+// Server responds back to sender with the nameplate, the public part of the transfer code.
+// [nameplate uint16 2bytes]
+type TransferCode struct {
+	Nameplate uint16
+}
+
+func (m *TransferCode) Type() uint8 { return shared.InitialTypeTransferCode }
+
+func (m *TransferCode) encodePayload() ([]byte, error) {
+	return binary.BigEndian.AppendUint16(nil, m.Nameplate), nil
+}
+
+func (m *TransferCode) decodePayload(payload []byte) error {
+	if err := expectLen(m, payload, 2); err != nil {
+		return err
+	}
+
+	m.Nameplate = binary.BigEndian.Uint16(payload)
+	return nil
+}
+
+// Sender sends the key of the manifest to the receiver, through the server.
+// The manifest itself is uploaded to the server before the transfer code is issued.
+// [sealed json encoded ManifestKey], which also says what kind of content is sent.
+type ReceiverMD struct {
+	Sealed []byte
+}
+
+func (m *ReceiverMD) Type() uint8 { return shared.InitialTypeReceiverMD }
+
+func (m *ReceiverMD) encodePayload() ([]byte, error) {
+	return m.Sealed, nil
+}
+
+func (m *ReceiverMD) decodePayload(payload []byte) error {
+	if err := expectMinLen(m, payload, 1); err != nil {
+		return err
+	}
+
+	m.Sealed = payload
+	return nil
+}
+
+// Seal the manifest key for the receiver.
+func SealReceiverMD(channel *secure.Channel, key *ManifestKey) (*ReceiverMD, error) {
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		return nil, fmt.Errorf("E:Encoding manifest key. %s", err.Error())
+	}
+
+	return &ReceiverMD{Sealed: channel.Seal(encoded)}, nil
+}
+
+// Open the sealed manifest key.
+func (m *ReceiverMD) Open(channel *secure.Channel) (*ManifestKey, error) {
+	encoded, err := channel.Open(m.Sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	var key ManifestKey
+	if err := json.Unmarshal(encoded, &key); err != nil {
+		return nil, &DecodeError{MessageType: m.Type(), Reason: "invalid manifest key. " + err.Error()}
+	}
+
+	return &key, nil
+}
+
+// Part of the sealed manifest. Uploaded by the sender to the server, which keeps it for the receiver.
+// [sealed part of json encoded []shared.FileInfo]
+type ManifestChunk struct {
+	Sealed []byte
+}
+
+func (m *ManifestChunk) Type() uint8 { return shared.InitialTypeManifestChunk }
+
+func (m *ManifestChunk) encodePayload() ([]byte, error) {
+	return m.Sealed, nil
+}
+
+func (m *ManifestChunk) decodePayload(payload []byte) error {
+	if err := expectMinLen(m, payload, 1); err != nil {
+		return err
+	}
+
+	m.Sealed = payload
+	return nil
+}
+
+// Sender finished uploading the manifest.
+// [chunks uint32 4bytes]
+type ManifestEnd struct {
+	Chunks uint32
+}
+
+func (m *ManifestEnd) Type() uint8 { return shared.InitialTypeManifestEnd }
+
+func (m *ManifestEnd) encodePayload() ([]byte, error) {
+	return binary.BigEndian.AppendUint32(nil, m.Chunks), nil
+}
+
+func (m *ManifestEnd) decodePayload(payload []byte) error {
+	if err := expectLen(m, payload, 4); err != nil {
+		return err
+	}
+
+	m.Chunks = binary.BigEndian.Uint32(payload)
+	return nil
+}
+
+// Server stored the manifest. Followed by the transfer code.
+// [chunks uint32 4bytes]
+type ManifestAck struct {
+	Chunks uint32
+}
+
+func (m *ManifestAck) Type() uint8 { return shared.InitialTypeManifestAck }
+
+func (m *ManifestAck) encodePayload() ([]byte, error) {
+	return binary.BigEndian.AppendUint32(nil, m.Chunks), nil
+}
+
+func (m *ManifestAck) decodePayload(payload []byte) error {
+	if err := expectLen(m, payload, 4); err != nil {
+		return err
+	}
+
+	m.Chunks = binary.BigEndian.Uint32(payload)
+	return nil
+}
+
+// Receiver invokes a transfer of file with given id from the sender.
+// [id uint32 4bytes]
+type StartTransferWithId struct {
+	Id uint32
+}
+
+func (m *StartTransferWithId) Type() uint8 { return shared.InitialTypeStartTransferWithId }
+
+func (m *StartTransferWithId) encodePayload() ([]byte, error) {
+	return binary.BigEndian.AppendUint32(nil, m.Id), nil
+}
+
+func (m *StartTransferWithId) decodePayload(payload []byte) error {
+	if err := expectLen(m, payload, 4); err != nil {
+		return err
+	}
+
+	m.Id = binary.BigEndian.Uint32(payload)
+	return nil
+}
+
+// Receiver resumes a file from the given offset, after reconnecting.
+// [id uint32 4bytes][offset uint64 8bytes]
+type StartTransferWithIdAtOffset struct {
+	Id     uint32
+	Offset uint64
+}
+
+func (m *StartTransferWithIdAtOffset) Type() uint8 {
+	return shared.InitialTypeStartTransferWithIdAtOffset
+}
+
+func (m *StartTransferWithIdAtOffset) encodePayload() ([]byte, error) {
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint32(nil, m.Id), m.Offset), nil
+}
+
+func (m *StartTransferWithIdAtOffset) decodePayload(payload []byte) error {
+	if err := expectLen(m, payload, 12); err != nil {
+		return err
+	}
+
+	m.Id = binary.BigEndian.Uint32(payload)
+	m.Offset = binary.BigEndian.Uint64(payload[4:])
+	return nil
+}
+
+// Receiver skips the file with given id, without any of it being sent.
+// [id uint32 4bytes]
+type SkipFile struct {
+	Id uint32
+}
+
+func (m *SkipFile) Type() uint8 { return shared.InitialTypeSkipFile }
+
+func (m *SkipFile) encodePayload() ([]byte, error) {
+	return binary.BigEndian.AppendUint32(nil, m.Id), nil
+}
+
+func (m *SkipFile) decodePayload(payload []byte) error {
+	if err := expectLen(m, payload, 4); err != nil {
+		return err
+	}
+
+	m.Id = binary.BigEndian.Uint32(payload)
+	return nil
+}
+
+// Receiver only receives the files with the given ids.
+// [id uint32 4bytes]...
+type SelectFiles struct {
+	Ids []uint32
+}
+
+func (m *SelectFiles) Type() uint8 { return shared.InitialTypeSelectFiles }
+
+func (m *SelectFiles) encodePayload() ([]byte, error) {
+	return encodeIds(m.Ids), nil
+}
+
+func (m *SelectFiles) decodePayload(payload []byte) (err error) {
+	m.Ids, err = decodeIds(m, payload)
+	return err
+}
+
+func encodeIds(ids []uint32) []byte {
+	payload := make([]byte, 0, 4*len(ids))
+	for _, id := range ids {
+		payload = binary.BigEndian.AppendUint32(payload, id)
+	}
+
+	return payload
+}
+
+func decodeIds(m Message, payload []byte) ([]uint32, error) {
+	if len(payload)%4 != 0 {
+		return nil, &DecodeError{MessageType: m.Type(), Reason: fmt.Sprintf("payload is %d bytes, expected a multiple of 4.", len(payload))}
+	}
+
+	ids := make([]uint32, 0, len(payload)/4)
+	for i := 0; i < len(payload); i += 4 {
+		ids = append(ids, binary.BigEndian.Uint32(payload[i:]))
+	}
+
+	return ids, nil
+}
+
+// Receiver asks for the files with the given ids as one tar stream, sent like a single file of unknown size.
+// Only in archive mode. Once it is sent, the transfer is done.
+// [id uint32 4bytes]...
+type StartArchive struct {
+	Ids []uint32
+}
+
+func (m *StartArchive) Type() uint8 { return shared.InitialTypeStartArchive }
+
+func (m *StartArchive) encodePayload() ([]byte, error) {
+	return encodeIds(m.Ids), nil
+}
+
+func (m *StartArchive) decodePayload(payload []byte) (err error) {
+	m.Ids, err = decodeIds(m, payload)
+	return err
+}
+
+// Receiver picks the codec the sender may compress transfer packets with.
+// Sent before the first file is requested, shared.CodecNone if none of the offered ones is supported.
+// [codec 1byte]
+type UseCodec struct {
+	Codec uint8
+}
+
+func (m *UseCodec) Type() uint8 { return shared.InitialTypeUseCodec }
+
+func (m *UseCodec) encodePayload() ([]byte, error) {
+	return []byte{m.Codec}, nil
+}
+
+func (m *UseCodec) decodePayload(payload []byte) error {
+	if err := expectLen(m, payload, 1); err != nil {
+		return err
+	}
+
+	m.Codec = payload[0]
+	return nil
+}
+
+// Server notifies the sender that the receiver disconnected and may reconnect.
+type ReceiverDisconnected struct{}
+
+func (m *ReceiverDisconnected) Type() uint8 { return shared.InitialTypeReceiverDisconnected }
+
+func (m *ReceiverDisconnected) encodePayload() ([]byte, error) { return nil, nil }
+
+func (m *ReceiverDisconnected) decodePayload(payload []byte) error { return expectLen(m, payload, 0) }
+
+// Receiver allows the sender to send Credits more chunks of the active file without waiting.
+// Credits add up. Starting a file resets them, the receiver grants again after requesting it.
+// [credits uint32 4bytes]
+type GrantCredit struct {
+	Credits uint32
+}
+
+func (m *GrantCredit) Type() uint8 { return shared.InitialTypeGrantCredit }
+
+func (m *GrantCredit) encodePayload() ([]byte, error) {
+	return binary.BigEndian.AppendUint32(nil, m.Credits), nil
+}
+
+func (m *GrantCredit) decodePayload(payload []byte) error {
+	if err := expectLen(m, payload, 4); err != nil {
+		return err
+	}
+
+	m.Credits = binary.BigEndian.Uint32(payload)
+	return nil
+}
+
+// A chunk of the active file from sender to receiver.
+// This is the only definition of the chunk layout, the receiver must not slice frames itself.
+// [Version 1byte][Type 1byte][timestamp int64 8bytes][flags 1byte][sealed datachunk...]
+type TransferPacket struct {
+	// Unix millis at which the sender read the chunk.
+	Timestamp int64
+	// shared.PacketFlagCompressed if the chunk was compressed, before it was sealed.
+	Flags uint8
+	// Sealed with the secure.Channel of the transfer.
+	Data []byte
+}
+
+const timestampLen = 8
+
+// Bytes before the data chunk of a transfer packet frame.
+const TransferPacketHeaderLen = HeaderLen + timestampLen + 1
+
+func (m *TransferPacket) Type() uint8 { return shared.InitialTypeTransferPacket }
+
+func (m *TransferPacket) encodePayload() ([]byte, error) {
+	payload := make([]byte, timestampLen+1+len(m.Data))
+	binary.BigEndian.PutUint64(payload, uint64(m.Timestamp))
+	payload[timestampLen] = m.Flags
+	copy(payload[timestampLen+1:], m.Data)
+	return payload, nil
+}
+
+func (m *TransferPacket) decodePayload(payload []byte) error {
+	if err := expectMinLen(m, payload, timestampLen+1); err != nil {
+		return err
+	}
+
+	m.Timestamp = int64(binary.BigEndian.Uint64(payload))
+	m.Flags = payload[timestampLen]
+	m.Data = payload[timestampLen+1:]
+	return nil
+}
+
+// A single file has finished transferring.
+// Streams carry their hash, only known once the whole stream was read.
+// [sealed hex sha256, empty if the hash was in the manifest]
+type SingleFileTransferFinish struct {
+	SealedHash []byte
+}
+
+func (m *SingleFileTransferFinish) Type() uint8 { return shared.InitialTypeSingleFileTransferFinish }
+
+func (m *SingleFileTransferFinish) encodePayload() ([]byte, error) { return m.SealedHash, nil }
+
+func (m *SingleFileTransferFinish) decodePayload(payload []byte) error {
+	m.SealedHash = payload
+	return nil
+}
+
+// All files have finished transferring.
+type AllTransferFinish struct{}
+
+func (m *AllTransferFinish) Type() uint8 { return shared.InitialTypeAllTransferFinish }
+
+func (m *AllTransferFinish) encodePayload() ([]byte, error) { return nil, nil }
+
+func (m *AllTransferFinish) decodePayload(payload []byte) error { return expectLen(m, payload, 0) }
+
+// Client, sender or receiver, requests the server to abort the transfer.
+type AbortTransfer struct{}
+
+func (m *AbortTransfer) Type() uint8 { return shared.InitialTypeAbortTransfer }
+
+func (m *AbortTransfer) encodePayload() ([]byte, error) { return nil, nil }
+
+func (m *AbortTransfer) decodePayload(payload []byte) error { return expectLen(m, payload, 0) }
+
+// Receiver declines the transfer after seeing the metadata.
+type ReceiverAbort struct{}
+
+func (m *ReceiverAbort) Type() uint8 { return shared.InitialAbortTransfer }
+
+func (m *ReceiverAbort) encodePayload() ([]byte, error) { return nil, nil }
+
+func (m *ReceiverAbort) decodePayload(payload []byte) error { return expectLen(m, payload, 0) }
+
+// SPAKE2 element of the sender or receiver.
+// [element...]
+type PakeMessage struct {
+	Element []byte
+}
+
+func (m *PakeMessage) Type() uint8 { return shared.InitialTypePakeMessage }
+
+func (m *PakeMessage) encodePayload() ([]byte, error) {
+	return m.Element, nil
+}
+
+func (m *PakeMessage) decodePayload(payload []byte) error {
+	if err := expectLen(m, payload, secure.ElementLen); err != nil {
+		return err
+	}
+
+	m.Element = payload
+	return nil
+}
+
+// Key confirmation of the sender or receiver.
+// [confirmation 32bytes]
+type PakeConfirm struct {
+	Confirmation []byte
+}
+
+func (m *PakeConfirm) Type() uint8 { return shared.InitialTypePakeConfirm }
+
+func (m *PakeConfirm) encodePayload() ([]byte, error) {
+	return m.Confirmation, nil
+}
+
+func (m *PakeConfirm) decodePayload(payload []byte) error {
+	if err := expectLen(m, payload, 32); err != nil {
+		return err
+	}
+
+	m.Confirmation = payload
+	return nil
+}
+
+// Server messages client.
+// [utf8 text...]
+type TextMessage struct {
+	Text string
+}
+
+func (m *TextMessage) Type() uint8 { return shared.InitialTypeTextMessage }
+
+func (m *TextMessage) encodePayload() ([]byte, error) {
+	return []byte(m.Text), nil
+}
+
+func (m *TextMessage) decodePayload(payload []byte) error {
+	m.Text = string(payload)
+	return nil
+}
+
+// Server notifies the client that the connection is going to be closed.
+type CloseConnNotify struct{}
+
+func (m *CloseConnNotify) Type() uint8 { return shared.InitialTypeCloseConnNotify }
+
+func (m *CloseConnNotify) encodePayload() ([]byte, error) { return nil, nil }
+
+func (m *CloseConnNotify) decodePayload(payload []byte) error { return expectLen(m, payload, 0) }
+
+// Client voluntarily disconnects.
+type CloseConn struct{}
+
+func (m *CloseConn) Type() uint8 { return shared.InitialTypeCloseConn }
+
+func (m *CloseConn) encodePayload() ([]byte, error) { return nil, nil }
+
+func (m *CloseConn) decodePayload(payload []byte) error { return expectLen(m, payload, 0) }
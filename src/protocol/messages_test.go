@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Frames are written out byte by byte, so a change to a layout or type byte fails here
+// rather than between two releases.
+func TestGoldenFrames(t *testing.T) {
+	element := bytes.Repeat([]byte{0xab}, 256)
+	confirmation := bytes.Repeat([]byte{0xcd}, 32)
+
+	tests := []struct {
+		name    string
+		message Message
+		frame   []byte
+	}{
+		{"TransferCode", &TransferCode{Nameplate: 0x1234}, []byte{0x02, 0x28, 0x12, 0x34}},
+		{"ReceiverMD", &ReceiverMD{Sealed: []byte{1, 2, 3}}, []byte{0x02, 0x21, 1, 2, 3}},
+		{"ManifestChunk", &ManifestChunk{Sealed: []byte{4, 5}}, []byte{0x02, 0x35, 4, 5}},
+		{"ManifestEnd", &ManifestEnd{Chunks: 3}, []byte{0x02, 0x36, 0, 0, 0, 3}},
+		{"ManifestAck", &ManifestAck{Chunks: 0x01020304}, []byte{0x02, 0x37, 1, 2, 3, 4}},
+		{"StartTransferWithId", &StartTransferWithId{Id: 7}, []byte{0x02, 0x30, 0, 0, 0, 7}},
+		{
+			"StartTransferWithIdAtOffset",
+			&StartTransferWithIdAtOffset{Id: 2, Offset: 0x0102030405060708},
+			[]byte{0x02, 0x33, 0, 0, 0, 2, 1, 2, 3, 4, 5, 6, 7, 8},
+		},
+		{"SkipFile", &SkipFile{Id: 0x0a0b0c0d}, []byte{0x02, 0x38, 0x0a, 0x0b, 0x0c, 0x0d}},
+		{"SelectFiles", &SelectFiles{Ids: []uint32{1, 0x100}}, []byte{0x02, 0x39, 0, 0, 0, 1, 0, 0, 1, 0}},
+		{"SelectFiles none", &SelectFiles{Ids: []uint32{}}, []byte{0x02, 0x39}},
+		{"StartArchive", &StartArchive{Ids: []uint32{3}}, []byte{0x02, 0x3b, 0, 0, 0, 3}},
+		{"UseCodec", &UseCodec{Codec: 1}, []byte{0x02, 0x3a, 1}},
+		{"ReceiverDisconnected", &ReceiverDisconnected{}, []byte{0x02, 0x34}},
+		{"GrantCredit", &GrantCredit{Credits: 64}, []byte{0x02, 0x22, 0, 0, 0, 64}},
+		{
+			"TransferPacket",
+			&TransferPacket{Timestamp: 0x0102030405060708, Flags: 1, Data: []byte{0xee, 0xff}},
+			[]byte{0x02, 0x06, 1, 2, 3, 4, 5, 6, 7, 8, 1, 0xee, 0xff},
+		},
+		{
+			"SingleFileTransferFinish",
+			&SingleFileTransferFinish{SealedHash: []byte{9, 9}},
+			[]byte{0x02, 0x23, 9, 9},
+		},
+		{"SingleFileTransferFinish without hash", &SingleFileTransferFinish{SealedHash: []byte{}}, []byte{0x02, 0x23}},
+		{"AllTransferFinish", &AllTransferFinish{}, []byte{0x02, 0x24}},
+		{"AbortTransfer", &AbortTransfer{}, []byte{0x02, 0x25}},
+		{"ReceiverAbort", &ReceiverAbort{}, []byte{0x02, 0x29}},
+		{"PakeMessage", &PakeMessage{Element: element}, append([]byte{0x02, 0x31}, element...)},
+		{"PakeConfirm", &PakeConfirm{Confirmation: confirmation}, append([]byte{0x02, 0x32}, confirmation...)},
+		{"TextMessage", &TextMessage{Text: "hi"}, []byte{0x02, 0x26, 'h', 'i'}},
+		{"CloseConnNotify", &CloseConnNotify{}, []byte{0x02, 0x27}},
+		{"CloseConn", &CloseConn{}, []byte{0x02, 0x08}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := Encode(test.message)
+			if err != nil {
+				t.Fatalf("Encode() = %v", err)
+			}
+
+			if !bytes.Equal(frame, test.frame) {
+				t.Errorf("Encode() = % x, want % x", frame, test.frame)
+			}
+
+			message, err := Decode(test.frame)
+			if err != nil {
+				t.Fatalf("Decode() = %v", err)
+			}
+
+			if !reflect.DeepEqual(message, test.message) {
+				t.Errorf("Decode() = %#v, want %#v", message, test.message)
+			}
+		})
+	}
+}
+
+func TestTransferPacketHeaderLen(t *testing.T) {
+	if TransferPacketHeaderLen != 11 {
+		t.Fatalf("TransferPacketHeaderLen = %d, want 11", TransferPacketHeaderLen)
+	}
+
+	data := []byte("chunk")
+	frame, err := Encode(&TransferPacket{Timestamp: 1, Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(frame[TransferPacketHeaderLen:], data) {
+		t.Errorf("data starts at % x, want % x", frame[TransferPacketHeaderLen:], data)
+	}
+}
+
+func TestDecodeInvalidFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"empty", []byte{}},
+		{"version only", []byte{0x02}},
+		{"old version", []byte{0x01, 0x28, 0, 1}},
+		{"unknown type", []byte{0x02, 0xff}},
+		{"TransferCode short", []byte{0x02, 0x28, 1}},
+		{"TransferCode long", []byte{0x02, 0x28, 1, 2, 3}},
+		{"ReceiverMD empty", []byte{0x02, 0x21}},
+		{"ManifestChunk empty", []byte{0x02, 0x35}},
+		{"ManifestEnd short", []byte{0x02, 0x36, 0, 0, 3}},
+		{"ManifestAck long", []byte{0x02, 0x37, 0, 0, 0, 0, 3}},
+		{"StartTransferWithId short", []byte{0x02, 0x30}},
+		{"StartTransferWithIdAtOffset short", []byte{0x02, 0x33, 0, 0, 0, 2, 1, 2, 3, 4, 5, 6, 7}},
+		{"StartTransferWithIdAtOffset long", []byte{0x02, 0x33, 0, 0, 0, 2, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{"SkipFile long", []byte{0x02, 0x38, 0, 0, 0, 0, 1}},
+		{"SelectFiles partial id", []byte{0x02, 0x39, 0, 0, 0, 1, 0}},
+		{"StartArchive partial id", []byte{0x02, 0x3b, 1}},
+		{"UseCodec empty", []byte{0x02, 0x3a}},
+		{"UseCodec long", []byte{0x02, 0x3a, 1, 1}},
+		{"GrantCredit short", []byte{0x02, 0x22, 1}},
+		{"TransferPacket short", []byte{0x02, 0x06, 0, 0, 0, 0, 0, 0, 0, 1}},
+		{"PakeMessage short", append([]byte{0x02, 0x31}, make([]byte, 255)...)},
+		{"PakeMessage long", append([]byte{0x02, 0x31}, make([]byte, 257)...)},
+		{"PakeConfirm short", append([]byte{0x02, 0x32}, make([]byte, 31)...)},
+		{"PakeConfirm long", append([]byte{0x02, 0x32}, make([]byte, 33)...)},
+		{"ReceiverDisconnected long", []byte{0x02, 0x34, 0}},
+		{"AllTransferFinish long", []byte{0x02, 0x24, 0}},
+		{"AbortTransfer long", []byte{0x02, 0x25, 0}},
+		{"ReceiverAbort long", []byte{0x02, 0x29, 0}},
+		{"CloseConnNotify long", []byte{0x02, 0x27, 0}},
+		{"CloseConn long", []byte{0x02, 0x08, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := Decode(test.frame)
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("Decode(% x) = %#v, %v, want a *DecodeError", test.frame, message, err)
+			}
+		})
+	}
+}
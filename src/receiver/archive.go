@@ -0,0 +1,162 @@
+package receiver
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/apooravm/tshare-client/src/protocol"
+	"github.com/apooravm/tshare-client/src/shared"
+	"github.com/apooravm/tshare-client/src/transport"
+)
+
+// Ask for all remaining files as one archive. Existing files are handled according to the conflict policy first.
+// An empty archive is still asked for, the sender finishes the transfer once it is sent.
+func (t *transfer) requestArchive(conn transport.Transport) error {
+	t.archiveFiles = make(map[string]*shared.FileInfo)
+	ids := []uint32{}
+	for i := range t.incomingFiles {
+		file := &t.incomingFiles[i]
+		if file.Type != shared.EntryTypeFile || t.fileIdsReceived[file.Id] || !t.isSelected(file.Id) {
+			continue
+		}
+
+		skipped, err := t.resolveIncomingFile(conn, file)
+		if err != nil {
+			return err
+		}
+
+		if skipped {
+			continue
+		}
+
+		ids = append(ids, file.Id)
+		t.archiveFiles[file.RelativePath] = file
+	}
+
+	if err := protocol.Write(conn, &protocol.StartArchive{Ids: ids}); err != nil {
+		return fmt.Errorf("E:Requesting archive. Forcing disconnect.\n%s", err.Error())
+	}
+
+	t.requestMadeTime = time.Now()
+	if err := protocol.Write(conn, &protocol.GrantCredit{Credits: t.flowControl.Start()}); err != nil {
+		return fmt.Errorf("E:Granting credit. Forcing disconnect.\n%s", err.Error())
+	}
+
+	return nil
+}
+
+// Unpack the archive as its chunks arrive, each file into place like one sent on its own.
+// Returns dropped if the connection failed, otherwise the archive itself was bad.
+func (t *transfer) receiveArchive(conn transport.Transport) (dropped bool, err error) {
+	packets := &archivePacketReader{t: t, conn: conn}
+	archive := tar.NewReader(packets)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return packets.readErr != nil, fmt.Errorf("E:Reading archive. %s", err.Error())
+		}
+
+		file := t.archiveFiles[header.Name]
+		if file == nil || header.Typeflag != tar.TypeReg || header.Size != int64(file.Size) {
+			return false, fmt.Errorf("E:Unexpected entry %q in archive.", header.Name)
+		}
+
+		delete(t.archiveFiles, header.Name)
+		if _, err := t.openActiveFile(file); err != nil {
+			return false, err
+		}
+
+		if _, err := io.Copy(activeFileWriter{t}, archive); err != nil {
+			_ = t.activeFileBeingReceived.Close()
+			t.activeFileBeingReceived = nil
+			return packets.readErr != nil, fmt.Errorf("E:Unpacking %s. %s", file.RelativePath, err.Error())
+		}
+
+		t.completeActiveFile(file)
+	}
+
+	// Read up to the end of the stream, past the end of the tar.
+	if _, err := io.Copy(io.Discard, packets); err != nil {
+		return packets.readErr != nil, err
+	}
+
+	return false, nil
+}
+
+// Reads the chunks of the archive off the connection, up to its SingleFileTransferFinish.
+type archivePacketReader struct {
+	t    *transfer
+	conn transport.Transport
+	// Opened chunk not read yet.
+	pending []byte
+	done    bool
+	// Set if the connection failed.
+	readErr error
+}
+
+func (r *archivePacketReader) Read(p []byte) (int, error) {
+	t := r.t
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		message, err := protocol.Read(r.conn)
+		if err != nil {
+			if _, ok := err.(*protocol.DecodeError); ok {
+				fmt.Fprintln(t.out, err.Error())
+				continue
+			}
+
+			r.readErr = err
+			return 0, err
+		}
+
+		switch message := message.(type) {
+		case *protocol.TransferPacket:
+			chunk, err := t.openChunk(message)
+			if err != nil {
+				return 0, err
+			}
+
+			t.progressBar.Show()
+			t.grantCredit(r.conn, len(chunk))
+			r.pending = chunk
+
+		case *protocol.SingleFileTransferFinish:
+			r.done = true
+
+		case *protocol.TextMessage:
+			if message.Text != "" {
+				fmt.Fprintf(t.out, "%s %s\n", shared.ColourSprintf("Server:", "cyan", false), message.Text)
+			}
+
+		case *protocol.CloseConnNotify:
+			t.closeConn = true
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Writes unpacked contents to the active file.
+type activeFileWriter struct {
+	t *transfer
+}
+
+func (w activeFileWriter) Write(p []byte) (int, error) {
+	t := w.t
+	n, err := t.activeFileBeingReceived.Write(p)
+	t.activeFileHasher.Write(p[:n])
+	t.progressBar.UpdateTransferredSize(n)
+	return n, err
+}
@@ -0,0 +1,30 @@
+package receiver
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/apooravm/tshare-client/src/protocol"
+	"github.com/apooravm/tshare-client/src/shared"
+	"github.com/apooravm/tshare-client/src/transport"
+)
+
+// Pick the first codec the sender offered that is accepted here.
+func (t *transfer) pickCodec(offered []uint8) uint8 {
+	for _, candidate := range offered {
+		if slices.Contains(t.opts.Codecs, candidate) {
+			return candidate
+		}
+	}
+
+	return shared.CodecNone
+}
+
+// Tell the sender which codec it may compress chunks with.
+func (t *transfer) sendCodec(conn transport.Transport) error {
+	if err := protocol.Write(conn, &protocol.UseCodec{Codec: t.codec}); err != nil {
+		return fmt.Errorf("E:Sending codec. Forcing disconnect.\n%s", err.Error())
+	}
+
+	return nil
+}
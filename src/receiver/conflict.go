@@ -0,0 +1,93 @@
+package receiver
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+// What to do when an incoming file already exists in the receive folder. Set with -onconflict.
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictSkip      = "skip"
+	ConflictRename    = "rename"
+	ConflictAsk       = "ask"
+)
+
+var ConflictPolicies = []string{ConflictOverwrite, ConflictSkip, ConflictRename, ConflictAsk}
+
+// Decide where an incoming file is written, according to the conflict policy.
+// Returns the relative path to write to, or skip if the file should not be received.
+func (t *transfer) resolveConflict(file *shared.FileInfo) (string, bool, error) {
+	targetPath, err := shared.SafeJoin(t.receiverPath, file.RelativePath)
+	if err != nil {
+		return "", false, err
+	}
+
+	if _, err := os.Lstat(targetPath); os.IsNotExist(err) {
+		return file.RelativePath, false, nil
+	}
+
+	policy := t.opts.OnConflict
+	if policy == ConflictAsk {
+		policy = t.askConflict(file.RelativePath)
+	}
+
+	switch policy {
+	case ConflictSkip:
+		return "", true, nil
+
+	case ConflictRename:
+		renamed, err := t.freeRelativePath(file.RelativePath)
+		return renamed, false, err
+
+	default:
+		return file.RelativePath, false, nil
+	}
+}
+
+func (t *transfer) askConflict(relativePath string) string {
+	for {
+		t.progressBar.PrintAbove(fmt.Sprintf("%s already exists. (o)verwrite/(s)kip/(r)ename?", relativePath))
+		res, err := shared.ScanWord(t.ctx)
+		if err != nil {
+			// No one to ask, keep what is there.
+			return ConflictSkip
+		}
+
+		switch strings.ToLower(res) {
+		case "o", "overwrite":
+			return ConflictOverwrite
+		case "s", "skip":
+			return ConflictSkip
+		case "r", "rename":
+			return ConflictRename
+		}
+	}
+}
+
+// First 'name (n).ext' next to relativePath that does not exist yet.
+func (t *transfer) freeRelativePath(relativePath string) (string, error) {
+	dir, name := path.Split(relativePath)
+	ext := path.Ext(name)
+	// '.bashrc' is all name.
+	if ext == name {
+		ext = ""
+	}
+
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s%s (%d)%s", dir, base, n, ext)
+		targetPath, err := shared.SafeJoin(t.receiverPath, candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := os.Lstat(targetPath); os.IsNotExist(err) {
+			return candidate, nil
+		}
+	}
+}
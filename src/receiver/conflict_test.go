@@ -0,0 +1,64 @@
+package receiver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFreeRelativePath(t *testing.T) {
+	tests := []struct {
+		name         string
+		existing     []string
+		relativePath string
+		want         string
+	}{
+		{"extension", []string{"a.txt"}, "a.txt", "a (1).txt"},
+		{"first rename taken", []string{"a.txt", "a (1).txt"}, "a.txt", "a (2).txt"},
+		{"gap in renames", []string{"a.txt", "a (2).txt"}, "a.txt", "a (1).txt"},
+		{"dotfile", []string{".bashrc"}, ".bashrc", ".bashrc (1)"},
+		{"dotfile with extension", []string{".env.local"}, ".env.local", ".env (1).local"},
+		{"no extension", []string{"Makefile"}, "Makefile", "Makefile (1)"},
+		{"double extension", []string{"a.tar.gz"}, "a.tar.gz", "a.tar (1).gz"},
+		{"already numbered", []string{"report (1).pdf"}, "report (1).pdf", "report (1) (1).pdf"},
+		{"nested", []string{"data/src/main.go"}, "data/src/main.go", "data/src/main (1).go"},
+		{"folder", []string{"data/build/"}, "data/build", "data/build (1)"},
+		{"taken by a folder", []string{"a.txt", "a (1).txt/"}, "a.txt", "a (2).txt"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, existing := range test.existing {
+				// A trailing '/' is a folder.
+				targetPath := filepath.Join(root, filepath.FromSlash(existing))
+				if strings.HasSuffix(existing, "/") {
+					if err := os.MkdirAll(targetPath, os.ModePerm); err != nil {
+						t.Fatal(err)
+					}
+
+					continue
+				}
+
+				if err := os.MkdirAll(filepath.Dir(targetPath), os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.WriteFile(targetPath, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tr := &transfer{receiverPath: root}
+			got, err := tr.freeRelativePath(test.relativePath)
+			if err != nil {
+				t.Fatalf("freeRelativePath(%q) = %v", test.relativePath, err)
+			}
+
+			if got != test.want {
+				t.Errorf("freeRelativePath(%q) = %q, want %q", test.relativePath, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package receiver
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+// Create a manifest entry that has no contents to request, an empty folder or a symlink.
+func (t *transfer) createEntry(file *shared.FileInfo) error {
+	switch file.Type {
+	case shared.EntryTypeDir:
+		return t.createDirEntry(file)
+	case shared.EntryTypeSymlink:
+		return t.createSymlinkEntry(file)
+	}
+
+	return nil
+}
+
+// Create an empty folder from the manifest. Without -preserve it is left out, as before.
+func (t *transfer) createDirEntry(file *shared.FileInfo) error {
+	if !t.opts.Preserve || t.stdoutSink != nil {
+		return nil
+	}
+
+	targetPath, err := shared.SafeJoin(t.receiverPath, file.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(targetPath, os.ModePerm); err != nil {
+		return fmt.Errorf("Could not create folder %s. %s", file.RelativePath, err.Error())
+	}
+
+	return t.applyFileMetadata(file.RelativePath, file)
+}
+
+// Recreate a symlink sent with -symlinks=preserve. Its target must stay inside the receive folder.
+// An existing link to the same target is left as is, anything else there is handled according to the conflict policy.
+func (t *transfer) createSymlinkEntry(file *shared.FileInfo) error {
+	if t.stdoutSink != nil {
+		return nil
+	}
+
+	if err := shared.ValidateLinkTarget(file.RelativePath, file.LinkTarget); err != nil {
+		return err
+	}
+
+	linkPath, err := t.symlinkPath(file.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	if existing, err := os.Lstat(linkPath); err == nil {
+		if target, err := os.Readlink(linkPath); err == nil && filepath.ToSlash(target) == file.LinkTarget {
+			return nil
+		}
+
+		policy := t.opts.OnConflict
+		if policy == ConflictAsk {
+			policy = t.askConflict(file.RelativePath)
+		}
+
+		switch policy {
+		case ConflictSkip:
+			fmt.Fprintln(t.out, shared.ColourSprintf(fmt.Sprintf("SKIP %s", file.RelativePath), "yellow", false))
+			return nil
+
+		case ConflictRename:
+			renamed, err := t.freeRelativePath(file.RelativePath)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(t.out, "%s exists, saving as %s\n", file.RelativePath, renamed)
+			if linkPath, err = t.symlinkPath(renamed); err != nil {
+				return err
+			}
+
+		default:
+			if existing.IsDir() {
+				return fmt.Errorf("Could not create link %s. A folder is in the way.", file.RelativePath)
+			}
+
+			if err := os.Remove(linkPath); err != nil {
+				return fmt.Errorf("Could not replace %s. %s", file.RelativePath, err.Error())
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(linkPath), os.ModePerm); err != nil {
+		return fmt.Errorf("Could not create dirs for link %s. %s", file.RelativePath, err.Error())
+	}
+
+	if err := os.Symlink(filepath.FromSlash(file.LinkTarget), linkPath); err != nil {
+		return fmt.Errorf("Could not create link %s. %s", file.RelativePath, err.Error())
+	}
+
+	// The target was only checked as text, make sure the links on disk did not lead it elsewhere.
+	if err := shared.ResolvesInside(t.receiverPath, linkPath); err != nil {
+		_ = os.Remove(linkPath)
+		return err
+	}
+
+	return nil
+}
+
+// Path to create a link at. Unlike SafeJoin, the last segment may already be a link, which is replaced.
+func (t *transfer) symlinkPath(relativePath string) (string, error) {
+	if err := shared.ValidateRelativePath(relativePath); err != nil {
+		return "", err
+	}
+
+	dir, name := path.Split(relativePath)
+	if dir == "" {
+		return filepath.Join(t.receiverPath, name), nil
+	}
+
+	dirPath, err := shared.SafeJoin(t.receiverPath, path.Clean(dir))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dirPath, name), nil
+}
@@ -0,0 +1,122 @@
+package receiver
+
+import (
+	"math"
+	"time"
+)
+
+// Default upper bound of the credit window, in chunks. Set with -window.
+const DefaultWindow = 64
+
+const (
+	minWindow     = 2
+	initialWindow = 8
+	// How long throughput is measured over before the window is resized.
+	rateInterval = time.Second
+)
+
+// Credit based flow control for the active file.
+// The sender streams as many chunks as it has credit for. Credit is topped up once half the
+// window is used, so the sender keeps streaming instead of waiting a round trip per chunk.
+// The window follows the bandwidth delay product of the link, measured from the grants.
+type FlowControl struct {
+	// Upper bound of the window. 1 requests every chunk on its own.
+	MaxWindow uint32
+
+	window uint32
+	// Credit granted but not yet used up by a received chunk.
+	outstanding uint32
+	// Chunks received of the active file.
+	received uint64
+
+	// Chunk paid for by the latest grant and when it was granted.
+	// Its arrival is at least a round trip later, the smallest such delay is taken as the rtt.
+	probeChunk   uint64
+	probeGranted time.Time
+	minRTT       time.Duration
+
+	rateStart   time.Time
+	rateBytes   int
+	bytesPerSec float64
+	chunkLen    int
+}
+
+// A maxWindow of 0 is taken as 1, no credit would ever be granted.
+func NewFlowControl(maxWindow uint32) *FlowControl {
+	maxWindow = max(maxWindow, 1)
+	return &FlowControl{
+		MaxWindow: maxWindow,
+		window:    min(initialWindow, maxWindow),
+	}
+}
+
+// Credit to grant when a file is requested. The rtt and throughput carry over between files.
+func (f *FlowControl) Start() uint32 {
+	f.outstanding = 0
+	f.received = 0
+	f.probeChunk = 0
+	f.rateStart = time.Now()
+	f.rateBytes = 0
+
+	return f.grant()
+}
+
+// Account for a received chunk of n bytes. Returns the credit to grant now, 0 for none.
+func (f *FlowControl) OnChunk(n int) uint32 {
+	now := time.Now()
+	f.received++
+	f.chunkLen = max(f.chunkLen, n)
+	if f.outstanding > 0 {
+		f.outstanding--
+	}
+
+	if f.received == f.probeChunk {
+		if rtt := now.Sub(f.probeGranted); f.minRTT == 0 || rtt < f.minRTT {
+			f.minRTT = rtt
+		}
+	}
+
+	f.rateBytes += n
+	if elapsed := now.Sub(f.rateStart); elapsed >= rateInterval {
+		f.bytesPerSec = float64(f.rateBytes) / elapsed.Seconds()
+		f.rateStart = now
+		f.rateBytes = 0
+		f.resize()
+	}
+
+	if f.outstanding > f.window/2 {
+		return 0
+	}
+
+	return f.grant()
+}
+
+// Top the credit up to the window.
+func (f *FlowControl) grant() uint32 {
+	credits := f.window - min(f.outstanding, f.window)
+	if credits == 0 {
+		return 0
+	}
+
+	// Chunks up to received+outstanding are already paid for, the next one needs this grant.
+	if f.probeChunk <= f.received {
+		f.probeChunk = f.received + uint64(f.outstanding) + 1
+		f.probeGranted = time.Now()
+	}
+
+	f.outstanding += credits
+	return credits
+}
+
+// Size the window to twice the chunks in flight over one rtt at the measured throughput.
+// Twice, since credit is only topped up at half the window. While the window is what limits
+// the throughput this doubles it every interval, until the link is the limit.
+func (f *FlowControl) resize() {
+	if f.minRTT == 0 || f.chunkLen == 0 {
+		return
+	}
+
+	inFlight := f.bytesPerSec * f.minRTT.Seconds() / float64(f.chunkLen)
+	window := uint32(min(math.Ceil(2*inFlight), float64(f.MaxWindow)))
+	f.window = min(max(window, minWindow), f.MaxWindow)
+}
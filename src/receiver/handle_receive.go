@@ -1,41 +1,130 @@
 package receiver
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"io"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/apooravm/tshare-client/src/protocol"
+	"github.com/apooravm/tshare-client/src/secure"
 	"github.com/apooravm/tshare-client/src/shared"
-	"github.com/gorilla/websocket"
+	"github.com/apooravm/tshare-client/src/transport"
 )
 
-var (
-	receiverPath     string
-	unique_code      uint8
-	count            = 1
-	transferMD       MDReceiver
-	totalArrivedSize int
+// Settings of a receive, from the CLI flags or a program running it in process.
+type Options struct {
+	// Relay to connect to.
+	Endpoint string
+	// Where messages, prompts and the progress bar are printed.
+	Output io.Writer
+	// Shown to the sender.
+	Name string
+	// Folder the files are received into.
+	Dir string
+	// Receives the single file of the transfer instead of Dir, with '-o -'.
+	Stdout *os.File
+	// Transfer code. Asked for if empty.
+	Code string
+	// Accept the transfer without asking.
+	Accept bool
+	// Upper bound of the credit window, in chunks.
+	Window uint32
+	// Policy applied to existing files, one of ConflictPolicies.
+	OnConflict string
+	// Files to receive, see ParseSelection. Empty receives every file.
+	Select string
+	// Apply the sender's file modes and mtimes and create empty folders.
+	Preserve bool
+	// Codecs accepted, preferred first.
+	Codecs      []uint8
+	Events      shared.TransferEvents
+	ProgressBar shared.ProgressBarOptions
+}
+
+// What a receive ended with.
+type Result struct {
+	// Set once all files were received, or the text.
+	Finished bool
+	// The text snippet of the transfer.
+	Text string
+	// Relative paths of files whose hash did not match the sender's.
+	FailedVerification []string
+}
+
+// State of a single receive. Each run gets its own, so a process can run several at once.
+type transfer struct {
+	opts Options
+	out  io.Writer
+	// Cancelled on Ctrl-C. Prompts stop waiting for an answer.
+	ctx context.Context
+
+	receiverPath string
+	// Full transfer code, keys the encryption.
+	transferCode string
 	// Toggled to true when server notifies that its about to close the connection.
-	CLOSE_CONN    = false
-	IncomingFiles []shared.FileInfo
+	closeConn     bool
+	incomingFiles []shared.FileInfo
 	// Keep track of file ids received
-	FileIdsReceived []uint8
+	fileIdsReceived map[uint32]bool
 
 	// Increment with every new file being transfered
-	ActiveTransferFileId    = 1
+	activeTransferFileId    uint32
 	activeFileBeingReceived *os.File
+	// Hash of the bytes written to activeFileBeingReceived so far.
+	activeFileHasher hash.Hash
+	// Relative path of the active file once complete. Differs from its own after -onconflict=rename.
+	activeFileRelativePath string
+	// Relative paths of files whose hash did not match the sender's.
+	failedVerification []string
 
 	progressBar *shared.ProgressBar
 
 	requestMadeTime  time.Time
 	dataReceivedTime time.Time
 
-	currTransferSpeed_bps float64
-)
+	// Set once the user accepted the transfer. Only then is a dropped connection retried.
+	transferAccepted bool
+	// Where a single file is written instead of the receive folder, with '-o -'.
+	stdoutSink *os.File
+	// Receiving from or to a stream. Nothing can be resumed.
+	streaming bool
+	// The text snippet of the transfer, printed on arrival.
+	receivedText string
+	// Bytes received per file, also saved next to the files for a later run to resume from.
+	resumeState *ResumeState
+	// Grants the sender credit for chunks of the active file.
+	flowControl *FlowControl
+
+	// Key exchange with the sender, keyed on the entered code.
+	pake *secure.Spake2
+	// Opens the metadata and file chunks. Only usable once the sender confirmed the key.
+	channel         *secure.Channel
+	channelVerified bool
+
+	// Sealed manifest, sent by the server on joining. Opened with the key in ReceiverMD.
+	manifestChunks []*protocol.ManifestChunk
+
+	// The sender packs the files into one tar stream, from ReceiverMD.
+	archiveMode bool
+	// Files asked for in the archive, by relative path.
+	archiveFiles map[string]*shared.FileInfo
+	// Codec picked for the transfer. Compressed chunks are decompressed with it.
+	codec uint8
+	// Ids of the files to receive. nil receives every file.
+	selectedFiles map[uint32]bool
+
+	// Set once all files were received, or the text.
+	finished bool
+}
 
 // Metadata for receiver from server
 type MDReceiver struct {
@@ -44,207 +133,897 @@ type MDReceiver struct {
 	Filename   string
 }
 
-func HandleReceiveArg(receiverName, targetDirPath, pbType string, pbRGBOn, pbIsMB bool, pbLength int, pbOff bool) error {
-	receiverPath = targetDirPath
+// Receive a transfer into opts.Dir, or opts.Stdout if set. The code is asked for if opts.Code is empty.
+// Cancelling ctx aborts the transfer and removes its partial files.
+func HandleReceiveArg(ctx context.Context, opts Options) (Result, error) {
+	out := opts.Output
+	if out == nil {
+		out = io.Discard
+	}
 
-	var resUniqueCode string
-	fmt.Println("Enter the code")
-	fmt.Scan(&resUniqueCode)
+	t := &transfer{
+		opts:                 opts,
+		out:                  out,
+		ctx:                  ctx,
+		receiverPath:         opts.Dir,
+		fileIdsReceived:      make(map[uint32]bool),
+		activeTransferFileId: 1,
+		stdoutSink:           opts.Stdout,
+		streaming:            opts.Stdout != nil,
+		flowControl:          NewFlowControl(opts.Window),
+		codec:                shared.CodecNone,
+	}
 
-	code, err := strconv.ParseUint(resUniqueCode, 10, 8)
-	if err != nil {
-		return fmt.Errorf("E:Could not parse input to uint8. Invalid input.")
+	err := t.receive(ctx)
+	return Result{Finished: t.finished, Text: t.receivedText, FailedVerification: t.failedVerification}, err
+}
+
+func (t *transfer) receive(ctx context.Context) error {
+	var nameplate uint16
+	for {
+		resCode := t.opts.Code
+		if resCode == "" {
+			fmt.Fprintln(t.out, "Enter the code")
+			var err error
+			if resCode, err = shared.ScanWord(ctx); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+
+				return fmt.Errorf("E:Reading code. %s", err.Error())
+			}
+		}
+
+		var err error
+		nameplate, t.transferCode, err = shared.ParseCode(resCode)
+		if err != nil {
+			// Given on the command line, no one to ask again.
+			if t.opts.Code != "" {
+				return err
+			}
+
+			fmt.Fprintln(t.out, err.Error())
+			continue
+		}
+
+		// Words were shortened, show what they completed to.
+		if t.transferCode != strings.ToLower(resCode) {
+			fmt.Fprintln(t.out, "Using code", t.transferCode)
+		}
+
+		break
 	}
 
-	unique_code = uint8(code)
+	// A previous run with the same code left partially received files behind.
+	if !t.streaming {
+		var err error
+		if t.resumeState, err = LoadResumeState(t.receiverPath, t.transferCode); err != nil {
+			fmt.Fprintln(t.out, "Ignoring invalid resume state.", err.Error())
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := t.connectAndReceive(ctx, nameplate)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Reconnecting would run into the same error. The transfer was aborted.
+		if _, ok := err.(*localError); ok {
+			return err
+		}
+
+		fmt.Fprintln(t.out, err.Error())
+		if !t.transferAccepted || t.streaming || attempt == MaxReconnectAttempts {
+			return nil
+		}
+
+		fmt.Fprintf(t.out, "Reconnecting in %s. Attempt %d/%d.\n", ReconnectDelay, attempt+1, MaxReconnectAttempts)
+		select {
+		case <-time.After(ReconnectDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
 
+// Connect to the server and run the transfer until it ends.
+// Returns an error if the connection dropped, in which case the transfer can be resumed.
+func (t *transfer) connectAndReceive(ctx context.Context, nameplate uint16) error {
 	queryParams := url.Values{}
 	queryParams.Add("intent", "receive")
-	queryParams.Add("code", strconv.Itoa(int(code)))
-	queryParams.Add("receivername", receiverName)
+	queryParams.Add("nameplate", strconv.Itoa(int(nameplate)))
+	queryParams.Add("receivername", t.opts.Name)
 
-	finalURL := fmt.Sprintf("%s?%s", shared.Endpoint, queryParams.Encode())
-	conn, err := shared.InitConnection(finalURL)
+	conn, err := transport.Dial(ctx, t.opts.Endpoint, queryParams)
 	if err != nil {
 		return err
 	}
 
 	defer conn.Close()
-	defer activeFileBeingReceived.Close()
+	stop := transport.InterruptReadsOnCancel(ctx, conn)
+	defer stop()
+
+	defer func() {
+		// The server ended the session before the transfer finished, it cannot be resumed.
+		if t.closeConn {
+			t.discardTransfer()
+		}
+
+		// Dropped, kept to resume from.
+		if t.activeFileBeingReceived != nil {
+			_ = t.activeFileBeingReceived.Close()
+			t.activeFileBeingReceived = nil
+		}
+
+		if t.resumeState != nil {
+			_ = t.resumeState.Save()
+		}
+	}()
+
+	// Fresh key exchange and manifest for every connection.
+	t.closeConn = false
+	t.manifestChunks = nil
+	t.channel = nil
+	t.channelVerified = false
 
-	if err := HandleReceiverConn(conn, pbType, pbRGBOn, pbIsMB, pbLength, pbOff); err != nil {
-		fmt.Println(err.Error())
+	t.pake, err = secure.NewSpake2(secure.RoleReceiver, []byte(t.transferCode))
+	if err != nil {
+		return err
 	}
 
-	return nil
+	if err := protocol.Write(conn, &protocol.PakeMessage{Element: t.pake.Message()}); err != nil {
+		return fmt.Errorf("E:Sending key exchange message. %s", err.Error())
+	}
+
+	return t.handleConn(ctx, conn)
 }
 
-func HandleReceiverConn(conn *websocket.Conn, pbType string, pbRGBOn, pbIsMB bool, pbLength int, pbOff bool) error {
+// Runs until the connection closes. Cancelling ctx aborts the transfer and returns ctx.Err().
+func (t *transfer) handleConn(ctx context.Context, conn transport.Transport) error {
 	for {
-		_, message, err := conn.ReadMessage()
+		message, err := protocol.Read(conn)
 		if err != nil {
-			if CLOSE_CONN {
-				fmt.Println("Server closed the connection.")
-				// No error is returned, graceful disconnect
-				return nil
+			if _, ok := err.(*protocol.DecodeError); ok {
+				fmt.Fprintln(t.out, err.Error())
+				continue
 			}
 
-			fmt.Println("Connection closed.")
-			return err
+			return t.readFailed(ctx, conn, err)
 		}
 
-		switch message[1] {
-		case shared.InitialTypeTextMessage:
-			if len(message) > 2 {
-				fmt.Printf("%s %s\n", shared.ColourSprintf("Server:", "cyan", false), string(message[2:]))
+		switch message := message.(type) {
+		case *protocol.TextMessage:
+			if message.Text != "" {
+				fmt.Fprintf(t.out, "%s %s\n", shared.ColourSprintf("Server:", "cyan", false), message.Text)
 			}
 
-		case shared.InitialTypeReceiverMD:
-			if err := json.Unmarshal(message[2:], &IncomingFiles); err != nil {
-				fmt.Println("Err umarshalling", err.Error())
-				// Request disconn ig
+		case *protocol.ManifestChunk:
+			t.manifestChunks = append(t.manifestChunks, message)
+
+		case *protocol.PakeMessage:
+			key, err := t.pake.Finish(message.Element)
+			if err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				t.abortTransfer(conn)
+				continue
+			}
+
+			t.channel, err = secure.NewChannel(key, secure.RoleReceiver)
+			if err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				t.abortTransfer(conn)
+				continue
 			}
 
-			if len(IncomingFiles) > 1 {
-				shared.ColourPrint("Receiving files", "yellow")
+			if err := protocol.Write(conn, &protocol.PakeConfirm{Confirmation: t.channel.Confirmation()}); err != nil {
+				fmt.Fprintln(t.out, "E:Sending key confirmation. Forcing disconnect.\n", err.Error())
+				_ = conn.Close()
+				return nil
+			}
+
+		case *protocol.PakeConfirm:
+			if t.channel == nil || !t.channel.VerifyConfirmation(message.Confirmation) {
+				fmt.Fprintln(t.out, "Key confirmation failed. Wrong code.")
+				t.abortTransfer(conn)
+				continue
+			}
+
+			t.channelVerified = true
+			shared.ColourFprint(t.out, "Secure channel established.", "green")
+
+		case *protocol.ReceiverMD:
+			if !t.channelVerified {
+				fmt.Fprintln(t.out, "Received metadata before the key exchange finished.")
+				t.abortTransfer(conn)
+				continue
+			}
+
+			manifestKey, err := message.Open(t.channel)
+			if err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				t.abortTransfer(conn)
+				continue
+			}
+
+			switch manifestKey.Kind {
+			case shared.ContentKindFiles:
+			case shared.ContentKindText:
+				// Nothing is written to disk, so there is nothing to accept.
+				t.printText(manifestKey.Text)
+				t.receivedText = manifestKey.Text
+				t.finished = true
+				continue
+			default:
+				fmt.Fprintf(t.out, "Unknown content kind %d. Update tshare to receive it.\n", manifestKey.Kind)
+				t.abortTransfer(conn)
+				continue
+			}
+
+			t.incomingFiles, err = protocol.OpenManifest(manifestKey, t.manifestChunks)
+			if err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				t.abortTransfer(conn)
+				continue
+			}
+
+			t.codec = t.pickCodec(manifestKey.Codecs)
+			t.archiveMode = manifestKey.Archive
+
+			if len(t.incomingFiles) == 0 {
+				fmt.Fprintln(t.out, "No files in the transfer.")
+				protocol.RequestCloseConn(conn)
+				continue
+			}
+
+			// Files are looked up by id, which must count up from 1 in order.
+			// Paths come from the sender and are checked before any is written.
+			if err := checkIncomingFiles(t.incomingFiles); err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				t.abortTransfer(conn)
+				continue
+			}
+
+			if len(t.incomingFiles) > 1 {
+				shared.ColourFprint(t.out, "Receiving files", "yellow")
 			} else {
 
-				shared.ColourPrint("Receiving file", "yellow")
+				shared.ColourFprint(t.out, "Receiving file", "yellow")
 			}
 
 			totalFileSize := 0
-			for _, file := range IncomingFiles {
+			for _, file := range t.incomingFiles {
 				totalFileSize += int(file.Size)
-				fmt.Printf("%d  %s - %s\n", file.Id, shared.ColourSprintf(fmt.Sprintf("[%.2fMB]", float64(file.Size)/float64(1000_000)), "yellow", false), file.RelativePath)
+				fmt.Fprintf(t.out, "%d  %s - %s\n", file.Id, shared.ColourSprintf(shared.EntrySizeText(&file), "yellow", false), file.RelativePath)
 			}
 
-			progressBar = shared.NewProgressBar(totalFileSize, pbType, pbLength, pbRGBOn, "", pbIsMB, pbOff)
+			t.progressBar = shared.NewProgressBar(totalFileSize, t.opts.ProgressBar, "", t.out)
+			t.progressBar.OnProgress = t.opts.Events.OnProgress
+			for _, file := range t.incomingFiles {
+				if file.SizeUnknown {
+					t.streaming = true
+					t.progressBar.SetSizeUnknown()
+				}
+			}
 
-			var resBeginTransfer string
-			fmt.Println("Begin transfer? (y/n)")
-			fmt.Scan(&resBeginTransfer)
+			if t.streaming {
+				t.resumeState = nil
+			}
+
+			if t.resumeState != nil && !t.resumeState.Matches(t.incomingFiles) {
+				fmt.Fprintln(t.out, "Files changed since the last attempt. Starting over.")
+				t.resumeState = nil
+			}
+
+			resuming := t.resumeState != nil
+			if resuming {
+				fmt.Fprintf(t.out, "Resuming. %d of %d file(s) already received.\n", len(t.resumeState.Completed), len(t.incomingFiles))
+			}
+
+			if t.opts.Select != "" && !t.transferAccepted {
+				t.selectedFiles, err = ParseSelection(t.opts.Select, t.incomingFiles, t.out)
+				if err != nil {
+					fmt.Fprintln(t.out, err.Error())
+					t.abortTransfer(conn)
+					continue
+				}
+
+				fmt.Fprintf(t.out, "Selected %d of %d files.\n", len(t.selectedFiles), len(t.incomingFiles))
+			}
+
+			// Reconnected within the same run, the user already accepted.
+			resBeginTransfer := "y"
+			if !t.transferAccepted && t.opts.Events.OnManifest != nil {
+				if !t.opts.Events.OnManifest(t.incomingFiles) {
+					resBeginTransfer = "n"
+				}
+			} else if !t.transferAccepted && !t.opts.Accept {
+				fmt.Fprintln(t.out, "Begin transfer? (y/n, s to select files)")
+				resBeginTransfer, err = shared.ScanWord(ctx)
+				if ctx.Err() != nil {
+					t.cancelTransfer(conn)
+					return ctx.Err()
+				}
+
+				if err != nil {
+					fmt.Fprintln(t.out, "E:Reading answer. Use -yes to accept without asking.", err.Error())
+					resBeginTransfer = "n"
+				}
+			}
+
+			if resBeginTransfer == "s" || resBeginTransfer == "S" {
+				t.selectedFiles, err = t.askSelection(t.incomingFiles)
+				if ctx.Err() != nil {
+					t.cancelTransfer(conn)
+					return ctx.Err()
+				}
+
+				if err != nil {
+					fmt.Fprintln(t.out, err.Error())
+					t.abortTransfer(conn)
+					continue
+				}
+
+				resBeginTransfer = "y"
+			}
 
 			if resBeginTransfer == "yes" || resBeginTransfer == "y" || resBeginTransfer == "Y" {
-				fmt.Println("Starting transfer")
+				if t.stdoutSink != nil && t.selectedCount() != 1 {
+					fmt.Fprintf(t.out, "Only a single file can be written to stdout, %d selected. Use -select.\n", t.selectedCount())
+					t.abortTransfer(conn)
+					continue
+				}
+
+				if !resuming {
+					fmt.Fprintln(t.out, "Starting transfer")
+					t.resumeState = NewResumeState(t.receiverPath, t.transferCode, t.incomingFiles)
+					t.resumeState.inMemory = t.streaming
+				}
+
+				t.transferAccepted = true
+				if err := t.resumeState.Save(); err != nil {
+					fmt.Fprintln(t.out, err.Error())
+				}
 
-				if err := CreateFileWithDirs(IncomingFiles[ActiveTransferFileId-1].RelativePath); err != nil {
-					fmt.Println(err.Error())
+				t.progressBar.SetTotalSize(t.selectedSize())
+
+				// Pick up after the files that completed before.
+				t.fileIdsReceived = make(map[uint32]bool)
+				remaining := 0
+				for _, file := range t.incomingFiles {
+					if !t.isSelected(file.Id) {
+						continue
+					}
+
+					// Nothing to request for empty folders and symlinks.
+					if file.Type != shared.EntryTypeFile && !t.resumeState.IsCompleted(file.Id) {
+						if err := t.createEntry(&file); err != nil {
+							fmt.Fprintln(t.out, err.Error())
+						}
+
+						t.resumeState.MarkCompleted(file.Id)
+					}
+
+					if t.resumeState.IsCompleted(file.Id) {
+						t.fileIdsReceived[file.Id] = true
+						t.progressBar.UpdateTransferredSize(int(file.Size))
+					} else {
+						remaining++
+					}
+				}
+
+				// Everything arrived, but the connection dropped before the sender was told.
+				if remaining == 0 {
+					t.finishTransfer()
+					protocol.RequestCloseConn(conn)
 					continue
 				}
 
-				// Start the transfer of a file with Id
-				startTransferWithFileIdPkt, _ := shared.CreateBinaryPacket(shared.Version, shared.InitialTypeStartTransferWithId, uint8(ActiveTransferFileId))
-				if err := conn.WriteMessage(websocket.BinaryMessage, startTransferWithFileIdPkt); err != nil {
-					fmt.Println("E:Requesting next packet. Forcing disconnect.\n", err.Error())
-					_ = conn.Close()
-					return nil
+				if err := t.sendCodec(conn); err != nil {
+					return t.requestFailed(ctx, conn, err)
+				}
+
+				if err := t.sendSelection(conn); err != nil {
+					return t.requestFailed(ctx, conn, err)
+				}
+
+				if t.archiveMode {
+					if err := t.requestArchive(conn); err != nil {
+						return t.requestFailed(ctx, conn, err)
+					}
+
+					dropped, err := t.receiveArchive(conn)
+					if err == nil {
+						continue
+					}
+
+					if !dropped {
+						fmt.Fprintln(t.out, err.Error())
+						t.abortTransfer(conn)
+						continue
+					}
+
+					return t.readFailed(ctx, conn, err)
 				}
 
-				progressBar.UpdateOngoingForNewFile(int(IncomingFiles[ActiveTransferFileId-1].Size))
+				t.activeTransferFileId = 1
+				if err := t.requestNextFile(conn); err != nil {
+					return t.requestFailed(ctx, conn, err)
+				}
 
 			} else {
 				// Abort transfer
-				fmt.Println("Aborting transfer")
-				abortpkt, _ := shared.CreateBinaryPacket(shared.Version, shared.InitialAbortTransfer)
-				if err := conn.WriteMessage(websocket.BinaryMessage, abortpkt); err != nil {
-					fmt.Println("E:Aborting transfer. Forcing disconnect.\n", err.Error())
+				fmt.Fprintln(t.out, "Aborting transfer")
+				if err := protocol.Write(conn, &protocol.ReceiverAbort{}); err != nil {
+					fmt.Fprintln(t.out, "E:Aborting transfer. Forcing disconnect.\n", err.Error())
 					_ = conn.Close()
 					return nil
 				}
 			}
 
-		case shared.InitialTypeTransferPacket:
-			if len(message) < 3 {
-				fmt.Println("Empty file chunk received.")
+		case *protocol.TransferPacket:
+			if !t.channelVerified {
 				continue
 			}
 
-			// Refer to shared.Packet
-			// [Version 1byte][Init_byte 1byte][timestamp int64 4byte][datachunk...]
-			dataReceivedTime = time.Now()
-			incomingFileChunk := message[7:]
+			if len(message.Data) == 0 {
+				fmt.Fprintln(t.out, "Empty file chunk received.")
+				continue
+			}
 
-			// duration := dataReceivedTime.Sub(requestMadeTime).Nanoseconds()
+			t.dataReceivedTime = time.Now()
+			incomingFileChunk, err := t.openChunk(message)
+			if err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				t.abortTransfer(conn)
+				continue
+			}
+
+			// Chunks can still be queued from before the user declined, or come from a sender out of step.
+			// They are opened all the same, every sealed payload moves the nonce counter on.
+			if t.activeFileBeingReceived == nil {
+				continue
+			}
+
+			// duration := t.dataReceivedTime.Sub(t.requestMadeTime).Nanoseconds()
 			// // bytes per nano sec
 			// currTransferSpeed_bps = float64(len(incomingFileChunk)) / float64(duration)
 			// // conv to bytes per sec
 			// currTransferSpeed_bps *= 1e9
 
-			// TODO: Add a connection close request here.
-			_, err = activeFileBeingReceived.Write(incomingFileChunk)
+			_, err = t.activeFileBeingReceived.Write(incomingFileChunk)
 			if err != nil {
-				fmt.Println("E:Writing data.", err.Error())
-				shared.RequestCloseConn(conn)
+				return t.requestFailed(ctx, conn, &localError{fmt.Errorf("E:Writing data. %s", err.Error())})
+			}
+
+			t.activeFileHasher.Write(incomingFileChunk)
+			if err := t.resumeState.AddWritten(t.activeTransferFileId, len(incomingFileChunk)); err != nil {
+				fmt.Fprintln(t.out, err.Error())
 			}
 
-			progressBar.UpdateTransferredSize(len(incomingFileChunk))
-			progressBar.Show()
+			t.progressBar.UpdateTransferredSize(len(incomingFileChunk))
+			t.progressBar.Show()
 
-			// fmt.Print("\033[0K") // Clear the line from the cursor to the end
-			requestMadeTime = time.Now()
-			nextPacketRequest, err := shared.CreateBinaryPacket(shared.Version, shared.InitialTypeRequestNextPacket)
-			if err != nil {
-				fmt.Println("\nCould not create next packet request.")
+			// fmt.Fprint(t.out, "\033[0K") // Clear the line from the cursor to the end
+			t.grantCredit(conn, len(incomingFileChunk))
+
+		case *protocol.SingleFileTransferFinish:
+			if t.activeFileBeingReceived == nil {
 				continue
 			}
 
-			if err := conn.WriteMessage(websocket.BinaryMessage, nextPacketRequest); err != nil {
-				fmt.Println("\nE:Writing file chunk.", err.Error())
-				shared.RequestCloseConn(conn)
-			}
+			// Streams send their hash at the end.
+			if len(message.SealedHash) != 0 {
+				streamHash, err := t.channel.Open(message.SealedHash)
+				if err != nil {
+					fmt.Fprintln(t.out, err.Error())
+					t.abortTransfer(conn)
+					continue
+				}
 
-		case shared.InitialTypeSingleFileTransferFinish:
-			if err := activeFileBeingReceived.Close(); err != nil {
-				fmt.Println("Could not close file.", IncomingFiles[ActiveTransferFileId-1].RelativePath, err.Error())
+				t.incomingFiles[t.activeTransferFileId-1].Hash = string(streamHash)
 			}
-			progressBar.PrintPostDoneMessage(fmt.Sprintf("Finished receiving file %s", IncomingFiles[ActiveTransferFileId-1].RelativePath))
 
-			FileIdsReceived = append(FileIdsReceived, uint8(ActiveTransferFileId))
+			t.completeActiveFile(&t.incomingFiles[t.activeTransferFileId-1])
+			if err := t.requestNextFile(conn); err != nil {
+				return t.requestFailed(ctx, conn, err)
+			}
 
-			// All files finished transferring
-			if len(FileIdsReceived) == len(IncomingFiles) {
-				continue
+		case *protocol.AllTransferFinish:
+			if t.receivedText == "" {
+				t.finishTransfer()
 			}
 
-			ActiveTransferFileId += 1
+		case *protocol.CloseConnNotify:
+			t.closeConn = true
+		}
 
-			if err := CreateFileWithDirs(IncomingFiles[ActiveTransferFileId-1].RelativePath); err != nil {
-				fmt.Println(err.Error())
-				continue
-			}
+	}
+}
 
-			// Start the transfer of a file with Id
-			startTransferWithFileIdPkt, _ := shared.CreateBinaryPacket(shared.Version, shared.InitialTypeStartTransferWithId, uint8(ActiveTransferFileId))
-			if err := conn.WriteMessage(websocket.BinaryMessage, startTransferWithFileIdPkt); err != nil {
-				fmt.Println("E:Requesting next packet. Forcing disconnect.\n", err.Error())
-				_ = conn.Close()
-				return nil
-			}
-			progressBar.UpdateOngoingForNewFile(int(IncomingFiles[ActiveTransferFileId-1].Size))
+// What the message loop returns once reading from conn failed.
+// nil if the server closed it, ctx.Err() if ctx was cancelled, which aborts the transfer.
+func (t *transfer) readFailed(ctx context.Context, conn transport.Transport, err error) error {
+	if ctx.Err() != nil {
+		t.cancelTransfer(conn)
+		return ctx.Err()
+	}
+
+	if t.closeConn {
+		fmt.Fprintln(t.out, "Server closed the connection.")
+		// No error is returned, graceful disconnect
+		return nil
+	}
+
+	fmt.Fprintln(t.out, "Connection closed.")
+	return err
+}
+
+// An error on this machine, like a file that cannot be created. Reconnecting would not help.
+type localError struct {
+	err error
+}
+
+func (e *localError) Error() string {
+	return e.err.Error()
+}
+
+// What the message loop returns once asking the sender for files failed.
+// A cancelled ctx or a localError aborts the transfer, anything else dropped the connection.
+func (t *transfer) requestFailed(ctx context.Context, conn transport.Transport, err error) error {
+	if ctx.Err() != nil {
+		t.cancelTransfer(conn)
+		return ctx.Err()
+	}
+
+	if _, ok := err.(*localError); ok {
+		t.abortTransfer(conn)
+		_ = conn.Close()
+		t.discardTransfer()
+		return err
+	}
+
+	_ = conn.Close()
+	return err
+}
+
+// Abort the transfer for a cancelled ctx, so the sender is not left waiting, and close the connection.
+// The code cannot be used again, so nothing is kept to resume from.
+func (t *transfer) cancelTransfer(conn transport.Transport) {
+	fmt.Fprintln(t.out, "\nTransfer cancelled.")
+	t.abortTransfer(conn)
+	_ = conn.Close()
+	t.discardTransfer()
+}
+
+// Remove the part files and resume state of a transfer that was aborted.
+func (t *transfer) discardTransfer() {
+	if t.resumeState != nil {
+		t.discardPartFiles()
+		if err := t.resumeState.Remove(); err != nil {
+			fmt.Fprintln(t.out, err.Error())
+		}
+
+		t.resumeState = nil
+	}
+}
+
+func checkIncomingFiles(files []shared.FileInfo) error {
+	for i, file := range files {
+		if file.Id != uint32(i+1) {
+			return fmt.Errorf("E:Invalid metadata. File %s has id %d, expected %d.", file.RelativePath, file.Id, i+1)
+		}
 
-		case shared.InitialTypeAllTransferFinish:
-			fmt.Println("\nAll files have been received.")
+		if err := shared.ValidateRelativePath(file.RelativePath); err != nil {
+			return err
+		}
+
+		if file.Type > shared.EntryTypeSymlink {
+			return fmt.Errorf("E:Invalid metadata. %s has unknown type %d.", file.RelativePath, file.Type)
+		}
+	}
+
+	return nil
+}
+
+// Print a received text snippet. With '-o -' only the text goes to stdout.
+func (t *transfer) printText(text string) {
+	if t.stdoutSink != nil {
+		fmt.Fprintln(t.stdoutSink, text)
+		return
+	}
 
-		case shared.InitialTypeCloseConnNotify:
-			CLOSE_CONN = true
+	shared.ColourFprint(t.out, "Received text", "yellow")
+	fmt.Fprintln(t.out, text)
+}
+
+// Report the end of the transfer and drop the resume state.
+func (t *transfer) finishTransfer() {
+	fmt.Fprintln(t.out, "\nAll files have been received.")
+	if len(t.failedVerification) != 0 {
+		shared.ColourFprint(t.out, fmt.Sprintf("%d file(s) failed verification:", len(t.failedVerification)), "red")
+		for _, relativePath := range t.failedVerification {
+			fmt.Fprintln(t.out, relativePath)
+		}
+	}
+
+	if t.resumeState != nil {
+		if err := t.resumeState.Remove(); err != nil {
+			fmt.Fprintln(t.out, err.Error())
 		}
 
+		t.resumeState = nil
 	}
+
+	t.finished = true
 }
 
-func CreateFileWithDirs(targetPath string) error {
-	targetPath = filepath.Join(receiverPath, targetPath)
-	var err error
+// Ask the sender for the next file not received yet, from activeTransferFileId on.
+// Files that already exist are handled according to the conflict policy, skipped ones are passed over.
+// Does nothing once all files are received or skipped, the sender then finishes the transfer.
+func (t *transfer) requestNextFile(conn transport.Transport) error {
+	for ; int(t.activeTransferFileId) <= len(t.incomingFiles); t.activeTransferFileId++ {
+		if t.fileIdsReceived[t.activeTransferFileId] || !t.isSelected(t.activeTransferFileId) {
+			continue
+		}
+
+		file := &t.incomingFiles[t.activeTransferFileId-1]
+		skipped, err := t.resolveIncomingFile(conn, file)
+		if err != nil {
+			return err
+		}
+
+		if skipped {
+			continue
+		}
+
+		return t.requestFile(conn, file)
+	}
+
+	return nil
+}
+
+// Handle the file according to the conflict policy if it already exists.
+// Returns true if it was skipped, the sender is told so.
+func (t *transfer) resolveIncomingFile(conn transport.Transport, file *shared.FileInfo) (bool, error) {
+	// A partially received file is resumed, not a conflict. Stdout has nothing to conflict with.
+	_, renamed := t.resumeState.Renamed[file.Id]
+	if t.stdoutSink != nil || renamed || t.resumeState.Offsets[file.Id] != 0 {
+		return false, nil
+	}
+
+	relativePath, skip, err := t.resolveConflict(file)
+	if err != nil {
+		return false, &localError{err}
+	}
+
+	if skip {
+		return true, t.skipFile(conn, file)
+	}
+
+	if relativePath != file.RelativePath {
+		t.progressBar.PrintAbove(fmt.Sprintf("%s exists, saving as %s", file.RelativePath, relativePath))
+		t.resumeState.Renamed[file.Id] = relativePath
+	}
+
+	return false, nil
+}
+
+// Tell the sender to skip the file and count it as done.
+func (t *transfer) skipFile(conn transport.Transport, file *shared.FileInfo) error {
+	t.progressBar.PrintAbove(shared.ColourSprintf(fmt.Sprintf("SKIP %s", file.RelativePath), "yellow", false))
+	if err := protocol.Write(conn, &protocol.SkipFile{Id: file.Id}); err != nil {
+		return fmt.Errorf("E:Skipping file. Forcing disconnect.\n%s", err.Error())
+	}
+
+	t.progressBar.UpdateTransferredSize(int(file.Size))
+	t.fileIdsReceived[file.Id] = true
+	t.resumeState.MarkCompleted(file.Id)
+	if err := t.resumeState.Save(); err != nil {
+		return &localError{err}
+	}
+
+	return nil
+}
+
+// Open the incoming file and ask the sender for it.
+// Continues from the resume offset if part of it was received before.
+func (t *transfer) requestFile(conn transport.Transport, file *shared.FileInfo) error {
+	offset, err := t.openActiveFile(file)
+	if err != nil {
+		return &localError{err}
+	}
+
+	var request protocol.Message = &protocol.StartTransferWithId{Id: file.Id}
+	if offset > 0 {
+		request = &protocol.StartTransferWithIdAtOffset{Id: file.Id, Offset: offset}
+	}
+
+	if err := protocol.Write(conn, request); err != nil {
+		return fmt.Errorf("E:Requesting file. Forcing disconnect.\n%s", err.Error())
+	}
+
+	t.requestMadeTime = time.Now()
+	if err := protocol.Write(conn, &protocol.GrantCredit{Credits: t.flowControl.Start()}); err != nil {
+		return fmt.Errorf("E:Granting credit. Forcing disconnect.\n%s", err.Error())
+	}
+
+	return nil
+}
+
+// Make the file the active one and open where it is written to, its part file or stdout.
+// Returns the offset it continues from.
+func (t *transfer) openActiveFile(file *shared.FileInfo) (uint64, error) {
+	relativePath := file.RelativePath
+	if renamed, ok := t.resumeState.Renamed[file.Id]; ok {
+		relativePath = renamed
+	}
+
+	t.activeTransferFileId = file.Id
+	t.activeFileRelativePath = relativePath
+	offset := uint64(0)
+	if t.stdoutSink != nil {
+		t.activeFileBeingReceived = t.stdoutSink
+		t.activeFileHasher = sha256.New()
+	} else {
+		var err error
+		offset, err = t.openIncomingFile(PartRelativePath(relativePath), t.resumeState.Offsets[file.Id])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	t.resumeState.Offsets[file.Id] = offset
+	t.progressBar.UpdateOngoingForNewFile(int(file.Size))
+	t.progressBar.UpdateTransferredSize(int(offset))
+	return offset, nil
+}
+
+// Close the active file once all of it arrived, verify it and move it into place.
+// A file that failed verification is left as its part file.
+func (t *transfer) completeActiveFile(file *shared.FileInfo) {
+	if err := t.activeFileBeingReceived.Close(); err != nil {
+		fmt.Fprintln(t.out, "Could not close file.", file.RelativePath, err.Error())
+	}
+	t.activeFileBeingReceived = nil
+	t.progressBar.PrintPostDoneMessage(fmt.Sprintf("Finished receiving file %s", file.RelativePath))
+
+	// Written to stdout as it arrived, there is nothing to move.
+	verified := t.verifyActiveFile(file)
+	switch {
+	case t.stdoutSink != nil:
+	case verified:
+		if err := t.commitActiveFile(); err != nil {
+			fmt.Fprintln(t.out, err.Error())
+		} else if err := t.applyFileMetadata(t.activeFileRelativePath, file); err != nil {
+			t.progressBar.PrintAbove(err.Error())
+		}
+	default:
+		t.progressBar.PrintAbove(fmt.Sprintf("Kept as %s", PartRelativePath(t.activeFileRelativePath)))
+	}
+
+	t.fileIdsReceived[file.Id] = true
+	t.resumeState.MarkCompleted(file.Id)
+	if err := t.resumeState.Save(); err != nil {
+		fmt.Fprintln(t.out, err.Error())
+	}
+}
+
+// Open a chunk of the active file, decompressing it if the sender compressed it.
+func (t *transfer) openChunk(packet *protocol.TransferPacket) ([]byte, error) {
+	chunk, err := t.channel.Open(packet.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if packet.Flags&shared.PacketFlagCompressed != 0 {
+		return shared.Decompress(t.codec, chunk)
+	}
+
+	return chunk, nil
+}
+
+// Count a received chunk of n bytes and grant the sender more credit if the window allows.
+func (t *transfer) grantCredit(conn transport.Transport, n int) {
+	credits := t.flowControl.OnChunk(n)
+	if credits == 0 {
+		return
+	}
+
+	t.requestMadeTime = time.Now()
+	if err := protocol.Write(conn, &protocol.GrantCredit{Credits: credits}); err != nil {
+		fmt.Fprintln(t.out, "\nE:Granting credit.", err.Error())
+		protocol.RequestCloseConn(conn)
+	}
+}
+
+// Open the incoming file for writing at offset, hashing what is already there.
+// Returns the offset actually continued from, which is smaller if the file on disk is shorter.
+func (t *transfer) openIncomingFile(relativePath string, offset uint64) (uint64, error) {
+	if offset == 0 {
+		return 0, t.createFileWithDirs(relativePath)
+	}
+
+	targetPath, err := shared.SafeJoin(t.receiverPath, relativePath)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(targetPath, os.O_RDWR, 0)
+	if err != nil {
+		// Partial file is gone, start it over.
+		return 0, t.createFileWithDirs(relativePath)
+	}
+
+	if info, err := file.Stat(); err == nil && uint64(info.Size()) < offset {
+		offset = uint64(info.Size())
+	}
+
+	// Anything past the saved offset may not have been recorded, drop it.
+	if err := file.Truncate(int64(offset)); err != nil {
+		_ = file.Close()
+		return 0, fmt.Errorf("E:Truncating partial file. %s", err.Error())
+	}
+
+	t.activeFileHasher = sha256.New()
+	if _, err := io.CopyN(t.activeFileHasher, file, int64(offset)); err != nil {
+		_ = file.Close()
+		return 0, fmt.Errorf("E:Hashing partial file. %s", err.Error())
+	}
+
+	t.activeFileBeingReceived = file
+	return offset, nil
+}
+
+// Ask the server to abort the transfer, which closes both connections.
+func (t *transfer) abortTransfer(conn transport.Transport) {
+	if err := protocol.Write(conn, &protocol.AbortTransfer{}); err != nil {
+		fmt.Fprintln(t.out, "E:Aborting transfer. Forcing disconnect.\n", err.Error())
+		_ = conn.Close()
+	}
+}
+
+func (t *transfer) createFileWithDirs(relativePath string) error {
+	targetPath, err := shared.SafeJoin(t.receiverPath, relativePath)
+	if err != nil {
+		return err
+	}
 
 	targetDir := filepath.Dir(targetPath)
 	if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
 		return fmt.Errorf("Could not create dirs for incoming file. %s.\n%s", targetPath, err.Error())
 	}
 
-	activeFileBeingReceived, err = os.Create(targetPath)
+	t.activeFileBeingReceived, err = os.Create(targetPath)
 	if err != nil {
 		return fmt.Errorf("Could not create incoming file. %s.\n%s", targetPath, err.Error())
 	}
 
+	t.activeFileHasher = sha256.New()
 	return nil
 }
+
+// Compare the hash of the bytes written for the active file against the one the sender computed.
+func (t *transfer) verifyActiveFile(file *shared.FileInfo) bool {
+	receivedHash := hex.EncodeToString(t.activeFileHasher.Sum(nil))
+
+	// Senders always hash what they send. A missing one cannot vouch for the file.
+	if file.Hash == "" {
+		t.failedVerification = append(t.failedVerification, file.RelativePath)
+		t.progressBar.PrintAbove(shared.ColourSprintf(fmt.Sprintf("FAIL %s. No checksum provided.", file.RelativePath), "red", false))
+		return false
+	}
+
+	if receivedHash != file.Hash {
+		t.failedVerification = append(t.failedVerification, file.RelativePath)
+		t.progressBar.PrintAbove(shared.ColourSprintf(fmt.Sprintf("FAIL %s. Checksum mismatch, expected %s got %s.", file.RelativePath, file.Hash, receivedHash), "red", false))
+		return false
+	}
+
+	t.progressBar.PrintAbove(shared.ColourSprintf(fmt.Sprintf("OK   %s", file.RelativePath), "green", false))
+	return true
+}
@@ -0,0 +1,66 @@
+package receiver
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+// Files are received into '.<name>.tshare-part' and renamed into place once complete and verified,
+// so anything watching the receive folder never sees a partial file at its final path.
+const PartFileSuffix = ".tshare-part"
+
+func PartRelativePath(relativePath string) string {
+	dir, name := path.Split(relativePath)
+	return dir + "." + name + PartFileSuffix
+}
+
+// Move the completed part file of the active file to its final path.
+func (t *transfer) commitActiveFile() error {
+	partPath, err := shared.SafeJoin(t.receiverPath, PartRelativePath(t.activeFileRelativePath))
+	if err != nil {
+		return err
+	}
+
+	targetPath, err := shared.SafeJoin(t.receiverPath, t.activeFileRelativePath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(partPath, targetPath); err != nil {
+		return fmt.Errorf("E:Moving received file into place. %s", err.Error())
+	}
+
+	return nil
+}
+
+// Remove the part files of all incomplete files in the resume state.
+// Used when the transfer ends without completing and cannot be resumed.
+func (t *transfer) discardPartFiles() {
+	if t.activeFileBeingReceived != nil {
+		_ = t.activeFileBeingReceived.Close()
+		t.activeFileBeingReceived = nil
+	}
+
+	for _, file := range t.resumeState.Files {
+		if t.resumeState.IsCompleted(file.Id) {
+			continue
+		}
+
+		relativePath := file.RelativePath
+		if renamed, ok := t.resumeState.Renamed[file.Id]; ok {
+			relativePath = renamed
+		}
+
+		partPath, err := shared.SafeJoin(t.receiverPath, PartRelativePath(relativePath))
+		if err != nil {
+			continue
+		}
+
+		if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(t.out, "Could not remove partial file.", err.Error())
+		}
+	}
+}
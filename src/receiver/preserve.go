@@ -0,0 +1,37 @@
+package receiver
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+// Apply the mode and mtime the sender recorded to a received file or folder.
+// Only the permission bits are applied, never setuid and the like.
+func (t *transfer) applyFileMetadata(relativePath string, file *shared.FileInfo) error {
+	if !t.opts.Preserve {
+		return nil
+	}
+
+	targetPath, err := shared.SafeJoin(t.receiverPath, relativePath)
+	if err != nil {
+		return err
+	}
+
+	if file.Mode != 0 {
+		if err := os.Chmod(targetPath, os.FileMode(file.Mode).Perm()); err != nil {
+			return fmt.Errorf("Could not set mode of %s. %s", relativePath, err.Error())
+		}
+	}
+
+	if file.ModTime != 0 {
+		modTime := time.Unix(0, file.ModTime)
+		if err := os.Chtimes(targetPath, modTime, modTime); err != nil {
+			return fmt.Errorf("Could not set modification time of %s. %s", relativePath, err.Error())
+		}
+	}
+
+	return nil
+}
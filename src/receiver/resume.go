@@ -0,0 +1,146 @@
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+// Sidecar file in the receive folder recording how far a transfer got.
+const ResumeStateFile = ".tshare-resume.json"
+
+// Reconnect attempts after the connection drops mid transfer.
+const (
+	MaxReconnectAttempts = 5
+	ReconnectDelay       = 2 * time.Second
+)
+
+// How often the received offsets are written to the sidecar file during a transfer.
+const resumeSaveInterval = time.Second
+
+// Progress of a transfer, saved so it can be continued after a disconnect.
+type ResumeState struct {
+	Code  string
+	Files []shared.FileInfo
+	// Bytes written per file id.
+	Offsets map[uint32]uint64
+	// Ids of files that finished and were closed, or were skipped.
+	Completed map[uint32]bool
+	// Relative paths files are written to instead of their own, after -onconflict=rename.
+	Renamed map[uint32]string
+
+	lastSaved time.Time
+	// Streams cannot be resumed, their state is never saved.
+	inMemory bool
+	// Receive folder the sidecar file is in.
+	dir string
+}
+
+func (s *ResumeState) path() string {
+	return filepath.Join(s.dir, ResumeStateFile)
+}
+
+// Load the saved state of a previous transfer with the same code from the receive folder dir.
+// nil if there is none, an error if the saved state is invalid.
+func LoadResumeState(dir, code string) (*ResumeState, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ResumeStateFile))
+	if err != nil {
+		return nil, nil
+	}
+
+	state := ResumeState{dir: dir}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	if state.Code != code {
+		return nil, nil
+	}
+
+	if state.Offsets == nil {
+		state.Offsets = make(map[uint32]uint64)
+	}
+
+	if state.Completed == nil {
+		state.Completed = make(map[uint32]bool)
+	}
+
+	if state.Renamed == nil {
+		state.Renamed = make(map[uint32]string)
+	}
+
+	return &state, nil
+}
+
+func NewResumeState(dir, code string, files []shared.FileInfo) *ResumeState {
+	return &ResumeState{
+		dir:       dir,
+		Code:      code,
+		Files:     files,
+		Offsets:   make(map[uint32]uint64),
+		Completed: make(map[uint32]bool),
+		Renamed:   make(map[uint32]string),
+	}
+}
+
+// Whether the state was saved for the same set of files.
+// The sender may have been restarted with the same code but different files.
+func (s *ResumeState) Matches(files []shared.FileInfo) bool {
+	return slices.Equal(s.Files, files)
+}
+
+func (s *ResumeState) IsCompleted(fileId uint32) bool {
+	return s.Completed[fileId]
+}
+
+func (s *ResumeState) MarkCompleted(fileId uint32) {
+	s.Completed[fileId] = true
+}
+
+// Record n more bytes written for the file. Saved at most every resumeSaveInterval.
+// The sidecar lagging behind the file is fine, the file is truncated to the saved offset on resume.
+func (s *ResumeState) AddWritten(fileId uint32, n int) error {
+	s.Offsets[fileId] += uint64(n)
+
+	if time.Since(s.lastSaved) < resumeSaveInterval {
+		return nil
+	}
+
+	return s.Save()
+}
+
+func (s *ResumeState) Save() error {
+	if s.inMemory {
+		return nil
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("E:Encoding resume state. %s", err.Error())
+	}
+
+	if err := os.WriteFile(s.path(), data, 0644); err != nil {
+		return fmt.Errorf("E:Saving resume state. %s", err.Error())
+	}
+
+	s.lastSaved = time.Now()
+	return nil
+}
+
+// Remove the sidecar file once the transfer is done.
+func (s *ResumeState) Remove() error {
+	if s.inMemory {
+		return nil
+	}
+
+	if err := os.Remove(s.path()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not remove resume state. %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package receiver
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/apooravm/tshare-client/src/protocol"
+	"github.com/apooravm/tshare-client/src/shared"
+	"github.com/apooravm/tshare-client/src/transport"
+)
+
+// Parse a selection of files, a comma separated list of
+// ids '3', ranges '2-5' and globs over relative paths 'data/src/**/*.go'.
+// Returns the ids of the selected files. Fails if nothing is selected, globs matching nothing are reported to out.
+func ParseSelection(input string, files []shared.FileInfo, out io.Writer) (map[uint32]bool, error) {
+	selected := make(map[uint32]bool)
+
+	for _, item := range strings.Split(input, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if first, last, ok := parseIdRange(item); ok {
+			if first == 0 || first > last || int(last) > len(files) {
+				return nil, fmt.Errorf("Invalid selection %q. Ids are 1-%d.", item, len(files))
+			}
+
+			for id := first; id <= last; id++ {
+				selected[id] = true
+			}
+
+			continue
+		}
+
+		if !shared.ValidGlob(item) {
+			return nil, fmt.Errorf("Invalid selection %q. Not an id, range or glob.", item)
+		}
+
+		matches := 0
+		for _, file := range files {
+			if shared.MatchGlob(item, file.RelativePath) {
+				selected[file.Id] = true
+				matches++
+			}
+		}
+
+		if matches == 0 {
+			fmt.Fprintf(out, "%q matches no files.\n", item)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("No files selected.")
+	}
+
+	return selected, nil
+}
+
+// '3' or '2-5'.
+func parseIdRange(item string) (uint32, uint32, bool) {
+	firstPart, lastPart, isRange := strings.Cut(item, "-")
+	first, err := strconv.ParseUint(firstPart, 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	if !isRange {
+		return uint32(first), uint32(first), true
+	}
+
+	last, err := strconv.ParseUint(lastPart, 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return uint32(first), uint32(last), true
+}
+
+func (t *transfer) isSelected(fileId uint32) bool {
+	return t.selectedFiles == nil || t.selectedFiles[fileId]
+}
+
+// Ask which files to receive until a valid selection is entered.
+func (t *transfer) askSelection(files []shared.FileInfo) (map[uint32]bool, error) {
+	for {
+		fmt.Fprintln(t.out, "Files to receive, comma separated ids, ranges or globs. E.g. 1,3-5,src/**/*.go")
+		res, err := shared.ScanWord(t.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("E:Reading selection. %s", err.Error())
+		}
+
+		selected, err := ParseSelection(res, files, t.out)
+		if err != nil {
+			fmt.Fprintln(t.out, err.Error())
+			continue
+		}
+
+		return selected, nil
+	}
+}
+
+// Tell the sender which files are selected. Nothing to tell if all of them are.
+func (t *transfer) sendSelection(conn transport.Transport) error {
+	if t.selectedFiles == nil {
+		return nil
+	}
+
+	ids := make([]uint32, 0, len(t.selectedFiles))
+	for _, file := range t.incomingFiles {
+		if t.selectedFiles[file.Id] {
+			ids = append(ids, file.Id)
+		}
+	}
+
+	if err := protocol.Write(conn, &protocol.SelectFiles{Ids: ids}); err != nil {
+		return fmt.Errorf("E:Sending selection. Forcing disconnect.\n%s", err.Error())
+	}
+
+	return nil
+}
+
+func (t *transfer) selectedCount() int {
+	if t.selectedFiles == nil {
+		return len(t.incomingFiles)
+	}
+
+	return len(t.selectedFiles)
+}
+
+// Total size of the selected files.
+func (t *transfer) selectedSize() int {
+	size := 0
+	for _, file := range t.incomingFiles {
+		if t.isSelected(file.Id) {
+			size += int(file.Size)
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,78 @@
+package receiver
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+func TestParseSelection(t *testing.T) {
+	files := []shared.FileInfo{
+		{Id: 1, RelativePath: "data/a.txt"},
+		{Id: 2, RelativePath: "data/b.txt"},
+		{Id: 3, RelativePath: "data/src/main.go"},
+		{Id: 4, RelativePath: "data/src/lib/util.go"},
+		{Id: 5, RelativePath: "data/README.md"},
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		// nil if the selection is invalid.
+		wantIds []uint32
+		// Globs reported as matching nothing.
+		wantNoMatch bool
+	}{
+		{"id", "3", []uint32{3}, false},
+		{"ids", "1,5", []uint32{1, 5}, false},
+		{"range", "2-4", []uint32{2, 3, 4}, false},
+		{"single id range", "4-4", []uint32{4}, false},
+		{"overlapping ranges", "1-3,2-4", []uint32{1, 2, 3, 4}, false},
+		{"repeated id", "2,2", []uint32{2}, false},
+		{"spaces and empty items", " 1 , ,3", []uint32{1, 3}, false},
+		{"glob", "data/src/**/*.go", []uint32{3, 4}, false},
+		{"glob on the name", "*.txt", []uint32{1, 2}, false},
+		{"glob and range", "*.md,1-2", []uint32{1, 2, 5}, false},
+		{"glob with no matches and an id", "*.rs,1", []uint32{1}, true},
+		{"glob with no matches", "*.rs", nil, true},
+		{"reversed range", "5-3", nil, false},
+		{"id zero", "0", nil, false},
+		{"id out of range", "6", nil, false},
+		{"range out of range", "4-6", nil, false},
+		{"range from zero", "0-2", nil, false},
+		{"invalid glob", "data/[", nil, false},
+		{"empty", "", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			selected, err := ParseSelection(test.input, files, &out)
+			if test.wantIds == nil {
+				if err == nil {
+					t.Fatalf("ParseSelection(%q) = %v, want an error", test.input, selected)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("ParseSelection(%q) = %v", test.input, err)
+				}
+
+				var ids []uint32
+				for id := range selected {
+					ids = append(ids, id)
+				}
+				slices.Sort(ids)
+
+				if !slices.Equal(ids, test.wantIds) {
+					t.Errorf("ParseSelection(%q) = %v, want %v", test.input, ids, test.wantIds)
+				}
+			}
+
+			if noMatch := bytes.Contains(out.Bytes(), []byte("matches no files")); noMatch != test.wantNoMatch {
+				t.Errorf("ParseSelection(%q) reported %q, want a glob with no matches reported %v", test.input, out.String(), test.wantNoMatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Seals and opens payloads between sender and receiver with keys derived from the SPAKE2 key.
+// Each direction has its own key and a message counter as the nonce, so the relay
+// cannot read, modify, drop, reorder or replay sealed payloads without Open failing.
+type Channel struct {
+	sendAEAD  cipher.AEAD
+	recvAEAD  cipher.AEAD
+	sendCount uint64
+	recvCount uint64
+
+	sendConfirmation []byte
+	recvConfirmation []byte
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func NewChannel(key []byte, role Role) (*Channel, error) {
+	senderToReceiver, err := newAEAD(deriveKey(key, "tshare sender to receiver"))
+	if err != nil {
+		return nil, fmt.Errorf("E:Creating cipher. %s", err.Error())
+	}
+
+	receiverToSender, err := newAEAD(deriveKey(key, "tshare receiver to sender"))
+	if err != nil {
+		return nil, fmt.Errorf("E:Creating cipher. %s", err.Error())
+	}
+
+	senderConfirmation := deriveKey(key, "tshare sender confirmation")
+	receiverConfirmation := deriveKey(key, "tshare receiver confirmation")
+
+	if role == RoleReceiver {
+		return &Channel{
+			sendAEAD:         receiverToSender,
+			recvAEAD:         senderToReceiver,
+			sendConfirmation: receiverConfirmation,
+			recvConfirmation: senderConfirmation,
+		}, nil
+	}
+
+	return &Channel{
+		sendAEAD:         senderToReceiver,
+		recvAEAD:         receiverToSender,
+		sendConfirmation: senderConfirmation,
+		recvConfirmation: receiverConfirmation,
+	}, nil
+}
+
+func nonce(aead cipher.AEAD, count uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], count)
+	return n
+}
+
+// Proof of the key sent to the peer. Lets both sides detect a wrong code before any file data is sent.
+func (c *Channel) Confirmation() []byte {
+	return c.sendConfirmation
+}
+
+func (c *Channel) VerifyConfirmation(confirmation []byte) bool {
+	return hmac.Equal(confirmation, c.recvConfirmation)
+}
+
+// Seal the next outgoing payload. Payloads must be opened in the order they were sealed.
+func (c *Channel) Seal(plaintext []byte) []byte {
+	sealed := c.sendAEAD.Seal(nil, nonce(c.sendAEAD, c.sendCount), plaintext, nil)
+	c.sendCount += 1
+	return sealed
+}
+
+// Open the next incoming payload.
+func (c *Channel) Open(sealed []byte) ([]byte, error) {
+	plaintext, err := c.recvAEAD.Open(nil, nonce(c.recvAEAD, c.recvCount), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("E:Decrypting payload. Data was modified in transit or sealed with a different key.")
+	}
+
+	c.recvCount += 1
+	return plaintext, nil
+}
@@ -0,0 +1,98 @@
+package secure
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A sender and receiver channel keyed on a matching exchange.
+func channels(t *testing.T) (*Channel, *Channel) {
+	t.Helper()
+
+	senderKey, receiverKey := exchange(t, "7-guitar-ocean", "7-guitar-ocean")
+	sender, err := NewChannel(senderKey, RoleSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := NewChannel(receiverKey, RoleReceiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sender, receiver
+}
+
+func TestChannelRoundTrip(t *testing.T) {
+	sender, receiver := channels(t)
+
+	if !receiver.VerifyConfirmation(sender.Confirmation()) || !sender.VerifyConfirmation(receiver.Confirmation()) {
+		t.Fatal("Confirmation failed with a matching code.")
+	}
+
+	for _, payload := range [][]byte{[]byte("first"), {}, bytes.Repeat([]byte("chunk"), 1000)} {
+		opened, err := receiver.Open(sender.Seal(payload))
+		if err != nil {
+			t.Fatalf("Open() = %v", err)
+		}
+
+		if !bytes.Equal(opened, payload) {
+			t.Fatalf("Open() = %q, want %q", opened, payload)
+		}
+	}
+
+	// The other direction has its own key and counter.
+	opened, err := sender.Open(receiver.Seal([]byte("reply")))
+	if err != nil || string(opened) != "reply" {
+		t.Fatalf("Open() = %q, %v, want reply", opened, err)
+	}
+}
+
+func TestChannelRejectsTampering(t *testing.T) {
+	tests := []struct {
+		name string
+		// Frames handed to Open in order, from the three sealed by the sender. The last one must fail.
+		open func(sealed [][]byte) [][]byte
+	}{
+		{"replayed", func(sealed [][]byte) [][]byte { return [][]byte{sealed[0], sealed[0]} }},
+		{"reordered", func(sealed [][]byte) [][]byte { return [][]byte{sealed[1]} }},
+		{"dropped", func(sealed [][]byte) [][]byte { return [][]byte{sealed[0], sealed[2]} }},
+		{"truncated", func(sealed [][]byte) [][]byte { return [][]byte{sealed[0][:len(sealed[0])-1]} }},
+		{"tag only", func(sealed [][]byte) [][]byte { return [][]byte{sealed[0][len(sealed[0])-16:]} }},
+		{"empty", func(sealed [][]byte) [][]byte { return [][]byte{{}} }},
+		{"flipped bit", func(sealed [][]byte) [][]byte {
+			flipped := bytes.Clone(sealed[0])
+			flipped[0] ^= 1
+			return [][]byte{flipped}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender, receiver := channels(t)
+			sealed := [][]byte{sender.Seal([]byte("zero")), sender.Seal([]byte("one")), sender.Seal([]byte("two"))}
+
+			frames := test.open(sealed)
+			for i, frame := range frames {
+				_, err := receiver.Open(frame)
+				last := i == len(frames)-1
+				if last && err == nil {
+					t.Fatalf("Open() accepted a %s frame", test.name)
+				}
+
+				if !last && err != nil {
+					t.Fatalf("Open() = %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestChannelRejectsReflection(t *testing.T) {
+	sender, _ := channels(t)
+
+	// The relay sending a frame back to the side that sealed it.
+	if _, err := sender.Open(sender.Seal([]byte("manifest key"))); err == nil {
+		t.Fatal("Opened a frame sealed by the same side.")
+	}
+}
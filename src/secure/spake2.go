@@ -0,0 +1,161 @@
+package secure
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// Which side of the exchange. The sender plays SPAKE2's A and the receiver B.
+type Role uint8
+
+const (
+	RoleSender Role = iota
+	RoleReceiver
+)
+
+// Size of an encoded group element.
+const ElementLen = 256
+
+// Prime p of the group below, big endian.
+var rfc3526Prime = [ElementLen]byte{
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xc9, 0x0f, 0xda, 0xa2, 0x21, 0x68, 0xc2, 0x34,
+	0xc4, 0xc6, 0x62, 0x8b, 0x80, 0xdc, 0x1c, 0xd1, 0x29, 0x02, 0x4e, 0x08, 0x8a, 0x67, 0xcc, 0x74,
+	0x02, 0x0b, 0xbe, 0xa6, 0x3b, 0x13, 0x9b, 0x22, 0x51, 0x4a, 0x08, 0x79, 0x8e, 0x34, 0x04, 0xdd,
+	0xef, 0x95, 0x19, 0xb3, 0xcd, 0x3a, 0x43, 0x1b, 0x30, 0x2b, 0x0a, 0x6d, 0xf2, 0x5f, 0x14, 0x37,
+	0x4f, 0xe1, 0x35, 0x6d, 0x6d, 0x51, 0xc2, 0x45, 0xe4, 0x85, 0xb5, 0x76, 0x62, 0x5e, 0x7e, 0xc6,
+	0xf4, 0x4c, 0x42, 0xe9, 0xa6, 0x37, 0xed, 0x6b, 0x0b, 0xff, 0x5c, 0xb6, 0xf4, 0x06, 0xb7, 0xed,
+	0xee, 0x38, 0x6b, 0xfb, 0x5a, 0x89, 0x9f, 0xa5, 0xae, 0x9f, 0x24, 0x11, 0x7c, 0x4b, 0x1f, 0xe6,
+	0x49, 0x28, 0x66, 0x51, 0xec, 0xe4, 0x5b, 0x3d, 0xc2, 0x00, 0x7c, 0xb8, 0xa1, 0x63, 0xbf, 0x05,
+	0x98, 0xda, 0x48, 0x36, 0x1c, 0x55, 0xd3, 0x9a, 0x69, 0x16, 0x3f, 0xa8, 0xfd, 0x24, 0xcf, 0x5f,
+	0x83, 0x65, 0x5d, 0x23, 0xdc, 0xa3, 0xad, 0x96, 0x1c, 0x62, 0xf3, 0x56, 0x20, 0x85, 0x52, 0xbb,
+	0x9e, 0xd5, 0x29, 0x07, 0x70, 0x96, 0x96, 0x6d, 0x67, 0x0c, 0x35, 0x4e, 0x4a, 0xbc, 0x98, 0x04,
+	0xf1, 0x74, 0x6c, 0x08, 0xca, 0x18, 0x21, 0x7c, 0x32, 0x90, 0x5e, 0x46, 0x2e, 0x36, 0xce, 0x3b,
+	0xe3, 0x9e, 0x77, 0x2c, 0x18, 0x0e, 0x86, 0x03, 0x9b, 0x27, 0x83, 0xa2, 0xec, 0x07, 0xa2, 0x8f,
+	0xb5, 0xc5, 0x5d, 0xf0, 0x6f, 0x4c, 0x52, 0xc9, 0xde, 0x2b, 0xcb, 0xf6, 0x95, 0x58, 0x17, 0x18,
+	0x39, 0x95, 0x49, 0x7c, 0xea, 0x95, 0x6a, 0xe5, 0x15, 0xd2, 0x26, 0x18, 0x98, 0xfa, 0x05, 0x10,
+	0x15, 0x72, 0x8e, 0x5a, 0x8a, 0xac, 0xaa, 0x68, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+}
+
+var (
+	// RFC 3526 2048-bit MODP group. p is a safe prime and g = 2 generates the subgroup of order q = (p-1)/2.
+	groupP = new(big.Int).SetBytes(rfc3526Prime[:])
+	groupQ = new(big.Int).Rsh(new(big.Int).Sub(groupP, big.NewInt(1)), 1)
+	groupG = big.NewInt(2)
+
+	// Blinding elements with no known discrete log, derived by hashing a label and squaring into the subgroup.
+	groupM = hashToGroup("tshare SPAKE2 M")
+	groupN = hashToGroup("tshare SPAKE2 N")
+)
+
+func hashToGroup(label string) *big.Int {
+	// Expand the label to more bits than p so the reduction is close to uniform.
+	var expanded []byte
+	for i := uint32(0); len(expanded) < ElementLen+32; i++ {
+		counter := make([]byte, 4)
+		binary.BigEndian.PutUint32(counter, i)
+		sum := sha256.Sum256(append([]byte(label), counter...))
+		expanded = append(expanded, sum[:]...)
+	}
+
+	n := new(big.Int).SetBytes(expanded)
+	n.Mod(n, groupP)
+	return n.Exp(n, big.NewInt(2), groupP)
+}
+
+// One side of a SPAKE2 exchange keyed on a shared low entropy password, the transfer code.
+// Both sides send Message() to each other through the relay and call Finish with the peer's.
+// They end up with the same key only if they used the same password, and the relay learns nothing it can brute force offline.
+type Spake2 struct {
+	role    Role
+	w       *big.Int
+	secret  *big.Int
+	element []byte
+}
+
+func NewSpake2(role Role, password []byte) (*Spake2, error) {
+	secret, err := rand.Int(rand.Reader, new(big.Int).Sub(groupQ, big.NewInt(1)))
+	if err != nil {
+		return nil, fmt.Errorf("E:Generating key exchange secret. %s", err.Error())
+	}
+
+	secret.Add(secret, big.NewInt(1))
+
+	passwordHash := sha256.Sum256(append([]byte("tshare SPAKE2 password"), password...))
+	w := new(big.Int).SetBytes(passwordHash[:])
+	w.Mod(w, groupQ)
+
+	blind := groupM
+	if role == RoleReceiver {
+		blind = groupN
+	}
+
+	// g^secret * blind^w
+	element := new(big.Int).Exp(groupG, secret, groupP)
+	element.Mul(element, new(big.Int).Exp(blind, w, groupP))
+	element.Mod(element, groupP)
+
+	return &Spake2{
+		role:    role,
+		w:       w,
+		secret:  secret,
+		element: element.FillBytes(make([]byte, ElementLen)),
+	}, nil
+}
+
+// The element to send to the peer.
+func (s *Spake2) Message() []byte {
+	return s.element
+}
+
+// Derive the shared key from the peer's element.
+func (s *Spake2) Finish(peerElement []byte) ([]byte, error) {
+	if len(peerElement) != ElementLen {
+		return nil, fmt.Errorf("E:Key exchange message is %d bytes, expected %d.", len(peerElement), ElementLen)
+	}
+
+	peer := new(big.Int).SetBytes(peerElement)
+	if peer.Cmp(big.NewInt(1)) <= 0 || peer.Cmp(new(big.Int).Sub(groupP, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("E:Invalid key exchange message.")
+	}
+
+	if new(big.Int).Exp(peer, groupQ, groupP).Cmp(big.NewInt(1)) != 0 {
+		return nil, fmt.Errorf("E:Invalid key exchange message.")
+	}
+
+	// Remove the peer's blinding and raise to our secret. (peer / peerBlind^w)^secret
+	peerBlind := groupN
+	if s.role == RoleReceiver {
+		peerBlind = groupM
+	}
+
+	unblind := new(big.Int).Exp(peerBlind, s.w, groupP)
+	unblind.ModInverse(unblind, groupP)
+
+	shared := new(big.Int).Mul(peer, unblind)
+	shared.Mod(shared, groupP)
+	shared.Exp(shared, s.secret, groupP)
+
+	senderElement, receiverElement := s.element, peerElement
+	if s.role == RoleReceiver {
+		senderElement, receiverElement = peerElement, s.element
+	}
+
+	transcript := sha256.New()
+	for _, part := range [][]byte{
+		[]byte("tshare SPAKE2 v1"),
+		senderElement,
+		receiverElement,
+		shared.FillBytes(make([]byte, ElementLen)),
+		s.w.Bytes(),
+	} {
+		length := make([]byte, 8)
+		binary.BigEndian.PutUint64(length, uint64(len(part)))
+		transcript.Write(length)
+		transcript.Write(part)
+	}
+
+	return transcript.Sum(nil), nil
+}
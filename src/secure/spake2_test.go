@@ -0,0 +1,126 @@
+package secure
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+// Run both sides of the exchange and return the sender's and receiver's keys.
+func exchange(t *testing.T, senderCode, receiverCode string) ([]byte, []byte) {
+	t.Helper()
+
+	sender, err := NewSpake2(RoleSender, []byte(senderCode))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := NewSpake2(RoleReceiver, []byte(receiverCode))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	senderKey, err := sender.Finish(receiver.Message())
+	if err != nil {
+		t.Fatalf("sender Finish() = %v", err)
+	}
+
+	receiverKey, err := receiver.Finish(sender.Message())
+	if err != nil {
+		t.Fatalf("receiver Finish() = %v", err)
+	}
+
+	return senderKey, receiverKey
+}
+
+func TestGroup(t *testing.T) {
+	if groupP.BitLen() != 8*ElementLen {
+		t.Fatalf("p is %d bits, want %d", groupP.BitLen(), 8*ElementLen)
+	}
+
+	if !groupP.ProbablyPrime(20) || !groupQ.ProbablyPrime(20) {
+		t.Fatal("p is not a safe prime.")
+	}
+
+	for name, element := range map[string]*big.Int{"g": groupG, "M": groupM, "N": groupN} {
+		if new(big.Int).Exp(element, groupQ, groupP).Cmp(big.NewInt(1)) != 0 {
+			t.Errorf("%s is not in the subgroup of order q.", name)
+		}
+	}
+
+	if groupM.Cmp(groupN) == 0 {
+		t.Error("M and N are the same element.")
+	}
+}
+
+func TestSpake2MatchingCode(t *testing.T) {
+	senderKey, receiverKey := exchange(t, "7-guitar-ocean", "7-guitar-ocean")
+	if !bytes.Equal(senderKey, receiverKey) {
+		t.Fatal("Same code derived different keys.")
+	}
+
+	// Fresh secrets every run, so the key differs even for the same code.
+	againKey, _ := exchange(t, "7-guitar-ocean", "7-guitar-ocean")
+	if bytes.Equal(senderKey, againKey) {
+		t.Fatal("Two exchanges with the same code derived the same key.")
+	}
+}
+
+func TestSpake2WrongCode(t *testing.T) {
+	senderKey, receiverKey := exchange(t, "7-guitar-ocean", "7-guitar-oceans")
+	if bytes.Equal(senderKey, receiverKey) {
+		t.Fatal("Different codes derived the same key.")
+	}
+
+	sender, err := NewChannel(senderKey, RoleSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := NewChannel(receiverKey, RoleReceiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receiver.VerifyConfirmation(sender.Confirmation()) || sender.VerifyConfirmation(receiver.Confirmation()) {
+		t.Fatal("Confirmation verified with a wrong code.")
+	}
+
+	if _, err := receiver.Open(sender.Seal([]byte("manifest key"))); err == nil {
+		t.Fatal("Opened a payload sealed with a wrong code.")
+	}
+}
+
+func TestSpake2InvalidMessage(t *testing.T) {
+	pMinus := func(n int64) []byte {
+		return new(big.Int).Sub(groupP, big.NewInt(n)).FillBytes(make([]byte, ElementLen))
+	}
+
+	tests := []struct {
+		name    string
+		element []byte
+	}{
+		{"empty", nil},
+		{"short", make([]byte, ElementLen-1)},
+		{"long", make([]byte, ElementLen+1)},
+		{"zero", make([]byte, ElementLen)},
+		{"one", big.NewInt(1).FillBytes(make([]byte, ElementLen))},
+		{"p - 1", pMinus(1)},
+		{"p", pMinus(0)},
+		// p is 7 mod 8, so -2 is not a square and not in the subgroup.
+		{"outside the subgroup", pMinus(2)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := NewSpake2(RoleSender, []byte("7-guitar-ocean"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := s.Finish(test.element); err == nil {
+				t.Errorf("Finish() accepted %s element", test.name)
+			}
+		})
+	}
+}
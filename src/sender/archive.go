@@ -0,0 +1,159 @@
+package sender
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+// When the files are sent as one tar stream instead of one by one. Set with -archive.
+const (
+	// Archive folders of many small files.
+	ArchiveAuto = "auto"
+	ArchiveOn   = "on"
+	ArchiveOff  = "off"
+)
+
+var ArchiveModes = []string{ArchiveAuto, ArchiveOn, ArchiveOff}
+
+// With -archive=auto, files are archived if there are at least archiveMinFiles
+// and they average less than archiveMaxAverageSize. Each file sent on its own costs a round trip.
+const (
+	archiveMinFiles       = 16
+	archiveMaxAverageSize = 64 * 1024
+)
+
+// Whether the files are sent as one archive.
+func useArchive(files []shared.FileInfo, mode string) bool {
+	count, size := 0, 0
+	for _, file := range files {
+		// Streams are a single file already.
+		if file.SizeUnknown {
+			return false
+		}
+
+		if file.Type == shared.EntryTypeFile {
+			count++
+			size += int(file.Size)
+		}
+	}
+
+	switch mode {
+	case ArchiveOn:
+		return count > 0
+	case ArchiveOff:
+		return false
+	}
+
+	return count >= archiveMinFiles && size/count < archiveMaxAverageSize
+}
+
+// Tar stream of files, built as it is read so it is never held in memory or written to disk.
+type archiveReader struct {
+	files []*shared.FileInfo
+	tar   *tar.Writer
+	// Archive bytes built but not read yet.
+	buf bytes.Buffer
+
+	// File whose contents are being added, and how much of it is left.
+	current   *os.File
+	remaining int64
+	// Bytes of file contents added since the last takeContentRead. Tar headers do not count.
+	contentRead int
+	done        bool
+}
+
+func newArchiveReader(files []*shared.FileInfo) *archiveReader {
+	archive := &archiveReader{files: files}
+	archive.tar = tar.NewWriter(&archive.buf)
+	return archive
+}
+
+// Fills p as far as the archive goes, so small files still make full chunks.
+func (a *archiveReader) Read(p []byte) (int, error) {
+	for a.buf.Len() < len(p) && !a.done {
+		if err := a.fill(len(p) - a.buf.Len()); err != nil {
+			return 0, err
+		}
+	}
+
+	if a.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return a.buf.Read(p)
+}
+
+// Add up to about n more bytes of the archive.
+func (a *archiveReader) fill(n int) error {
+	if a.current != nil {
+		copied, err := io.CopyN(a.tar, a.current, min(int64(n), a.remaining))
+		a.remaining -= copied
+		a.contentRead += int(copied)
+		if err != nil {
+			return fmt.Errorf("E:Adding file to archive. %s", err.Error())
+		}
+
+		if a.remaining == 0 {
+			_ = a.current.Close()
+			a.current = nil
+		}
+
+		return nil
+	}
+
+	if len(a.files) == 0 {
+		a.done = true
+		return a.tar.Close()
+	}
+
+	file := a.files[0]
+	a.files = a.files[1:]
+
+	current, err := os.Open(file.AbsPath)
+	if err != nil {
+		return fmt.Errorf("E:Opening file. %s", err.Error())
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     file.RelativePath,
+		Size:     int64(file.Size),
+		Mode:     0644,
+	}
+
+	if err := a.tar.WriteHeader(header); err != nil {
+		_ = current.Close()
+		return fmt.Errorf("E:Adding file to archive. %s", err.Error())
+	}
+
+	a.current = current
+	a.remaining = header.Size
+	if a.remaining == 0 {
+		_ = a.current.Close()
+		a.current = nil
+	}
+
+	return nil
+}
+
+// Bytes of file contents added since the last call.
+func (a *archiveReader) takeContentRead() int {
+	contentRead := a.contentRead
+	a.contentRead = 0
+	return contentRead
+}
+
+func (a *archiveReader) Close() error {
+	a.done = true
+	if a.current != nil {
+		_ = a.current.Close()
+		a.current = nil
+	}
+
+	return nil
+}
@@ -1,48 +1,102 @@
 package sender
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"net/url"
 	"os"
-	"strconv"
+	"slices"
 	"time"
 
+	"github.com/apooravm/tshare-client/src/protocol"
+	"github.com/apooravm/tshare-client/src/secure"
 	"github.com/apooravm/tshare-client/src/shared"
-	"github.com/gorilla/websocket"
+	"github.com/apooravm/tshare-client/src/transport"
 )
 
-var (
-	unique_code  uint8
-	fileToBeSent *os.File
-	chunkSize    uint32
-	sendBuf      []byte
-	sendCount    = 1
-	// Toggled to true when server notifies that its about to close the connection.
-	CLOSE_CONN          = false
-	activeFileIdx       uint8
-	activeFileBeingSent *os.File
-	filesBeingSent      *[]shared.FileInfo
-	fileDataPacket      []byte
-	// Keep track of file ids sent
-	FileIdsSent       []uint8
-	CurrFileBeingSent *shared.FileInfo
-	TotalFilesSize    int
-	CurrFileSentSize  int
-	TotalFileSentSize int
-
-	allFilesTotalSize  int
-	allFilesSentSize   int
-	allFilesSingleBlip int
+// Settings of a send, from the CLI flags or a program running it in process.
+type Options struct {
+	// Relay to connect to.
+	Endpoint string
+	// Where messages and the progress bar are printed.
+	Output io.Writer
+	// Shown to the receiver.
+	Name string
+	// Entries to send, with ids counting up from 1. A single entry of unknown size streams stdin.
+	Files []shared.FileInfo
+	// Bytes per chunk.
+	ChunkSize uint32
+	// Words in the secret part of the transfer code.
+	CodeWords int
+	// Codecs offered to the receiver, preferred first.
+	Codecs []uint8
+	// When the files are sent as one archive, one of ArchiveModes.
+	Archive     string
+	Events      shared.TransferEvents
+	ProgressBar shared.ProgressBarOptions
+}
 
-	currFileSentSize   int
-	currFileSingleBlip int
+// What a send ended with.
+type Result struct {
+	// Set once the receiver was told every file was sent, or got the text.
+	Finished bool
+}
 
-	transferStarted bool
+// State of a single send. Each run gets its own, so a process can run several at once.
+type transfer struct {
+	opts Options
+	out  io.Writer
 
-	progressBar       *shared.ProgressBar
-	currTransferSpeed float64
-)
+	// Full transfer code, keys the encryption. Only the nameplate part comes from the server.
+	transferCode string
+	// Secret part of the transfer code, generated locally.
+	codeWords []string
+	sendBuf   []byte
+	// Toggled to true when server notifies that its about to close the connection.
+	closeConn bool
+	// The file being sent, stdin or an archive.
+	activeFileBeingSent io.ReadCloser
+	// Set while activeFileBeingSent is an archive.
+	activeArchive *archiveReader
+	files         []shared.FileInfo
+	// Keep track of file ids sent
+	fileIdsSent       map[uint32]bool
+	currFileBeingSent *shared.FileInfo
+
+	// Chunks of the active file the receiver is ready for.
+	credits uint32
+
+	// Hash of stdin so far. Streams are hashed while sent, not up front.
+	streamHasher hash.Hash
+	// Set once stdin was opened. It cannot be read again.
+	stdinOpened bool
+
+	// Compresses chunks with the codec the receiver picked. Never nil, compresses nothing until then.
+	compressor *shared.Compressor
+	// Whether chunks of the active file are worth compressing.
+	compressActiveFile bool
+	// The first chunk of the active file is sampled before anything is compressed.
+	activeFileSampled bool
+
+	progressBar *shared.ProgressBar
+
+	// Key exchange with the receiver, started once the transfer code is known.
+	pake *secure.Spake2
+	// Seals the metadata and file chunks. Only usable once the receiver confirmed the key.
+	channel         *secure.Channel
+	channelVerified bool
+
+	// Key of the manifest uploaded to the server, sent to the receiver once the channel is verified.
+	manifestKey *protocol.ManifestKey
+	// Sealed manifest chunks, uploaded right after connecting.
+	manifestChunks []*protocol.ManifestChunk
+
+	finished bool
+}
 
 // Since handshake is a 1 time thing, it will be done through json
 type ClientHandshake struct {
@@ -55,179 +109,629 @@ type ClientHandshake struct {
 	Filename   string
 }
 
-func HandleSendArg(chunk_size uint32, filesize int64, senderName string, allFileInfo *[]shared.FileInfo, pbType string, pbRGBOn, pbIsMB bool, pbLength int, pbOff bool) error {
-	paramQuery := url.Values{}
-	filesBeingSent = allFileInfo
-	chunkSize = chunk_size
+func newTransfer(opts Options) (*transfer, error) {
+	codeWords, err := shared.GenerateCodeWords(opts.CodeWords)
+	if err != nil {
+		return nil, err
+	}
 
-	totalFileSize := 0
+	out := opts.Output
+	if out == nil {
+		out = io.Discard
+	}
 
-	for _, info := range *allFileInfo {
-		totalFileSize += int(info.Size)
-		infoValue := fmt.Sprintf("%s,%s,%d", info.RelativePath, strconv.Itoa(int(info.Size)), info.Id)
-		paramQuery.Add("fileinfo", infoValue)
+	return &transfer{
+		opts:        opts,
+		out:         out,
+		codeWords:   codeWords,
+		files:       opts.Files,
+		fileIdsSent: make(map[uint32]bool),
+		compressor:  shared.NewCompressor(shared.CodecNone),
+	}, nil
+}
+
+// Send opts.Files. Cancelling ctx aborts the transfer.
+func HandleSendArg(ctx context.Context, opts Options) (Result, error) {
+	if len(opts.Files) == 0 {
+		return Result{}, fmt.Errorf("No files to send.")
 	}
 
-	progressBar = shared.NewProgressBar(totalFileSize, pbType, pbLength, pbRGBOn, "", pbIsMB, pbOff)
+	t, err := newTransfer(opts)
+	if err != nil {
+		return Result{}, err
+	}
 
-	paramQuery.Add("intent", "send")
-	paramQuery.Add("sendername", senderName)
+	totalFileSize := 0
+
+	for _, info := range t.files {
+		totalFileSize += int(info.Size)
 
-	finalURL := fmt.Sprintf("%s?%s", shared.Endpoint, paramQuery.Encode())
+		// Empty folders and symlinks are created by the receiver from the manifest alone.
+		if info.Type != shared.EntryTypeFile {
+			t.fileIdsSent[info.Id] = true
+		}
+	}
 
-	conn, err := shared.InitConnection(finalURL)
+	// File metadata is sealed before it leaves. Its key is only sent to the receiver once the key exchange is done.
+	t.manifestKey, t.manifestChunks, err = protocol.SealManifest(t.files)
 	if err != nil {
-		return err
+		return Result{}, err
+	}
+
+	t.manifestKey.Codecs = opts.Codecs
+	t.manifestKey.Archive = useArchive(t.files, opts.Archive)
+
+	t.progressBar = shared.NewProgressBar(totalFileSize, opts.ProgressBar, "", t.out)
+	t.progressBar.OnProgress = opts.Events.OnProgress
+	if t.files[0].SizeUnknown {
+		t.progressBar.SetSizeUnknown()
 	}
 
-	if len(*allFileInfo) > 1 {
-		shared.ColourPrint("Sending files", "yellow")
+	if len(t.files) > 1 {
+		shared.ColourFprint(t.out, "Sending files", "yellow")
 	} else {
 
-		shared.ColourPrint("Sending file", "yellow")
+		shared.ColourFprint(t.out, "Sending file", "yellow")
 	}
 
-	for _, file := range *allFileInfo {
-		fmt.Printf("%d  %s - %s\n", file.Id, shared.ColourSprintf(fmt.Sprintf("[%.2fMB]", float64(file.Size)/float64(1000_000)), "yellow", false), file.RelativePath)
+	for _, file := range t.files {
+		fmt.Fprintf(t.out, "%d  %s - %s\n", file.Id, shared.ColourSprintf(shared.EntrySizeText(&file), "yellow", false), file.RelativePath)
+	}
+
+	if t.manifestKey.Archive {
+		fmt.Fprintln(t.out, "Sending the files as one archive.")
+	}
+
+	err = t.connectAndSend(ctx)
+	return Result{Finished: t.finished}, err
+}
+
+// Send a text snippet instead of files. It is sealed into the metadata, nothing is streamed.
+// opts.Files, the chunk size, codecs and archive mode are not used.
+func HandleSendTextArg(ctx context.Context, text string, opts Options) (Result, error) {
+	if text == "" {
+		return Result{}, fmt.Errorf("No text to send.")
+	}
+
+	if len(text) > shared.MaxTextSize {
+		return Result{}, fmt.Errorf("Text is longer than %d bytes. Send it as a file instead.", shared.MaxTextSize)
+	}
+
+	opts.Files = []shared.FileInfo{}
+	t, err := newTransfer(opts)
+	if err != nil {
+		return Result{}, err
+	}
+
+	t.manifestKey, t.manifestChunks, err = protocol.SealManifest(t.files)
+	if err != nil {
+		return Result{}, err
+	}
+
+	t.manifestKey.Kind = shared.ContentKindText
+	t.manifestKey.Text = text
+
+	// Nothing to show progress for.
+	t.progressBar = shared.NewProgressBar(0, shared.ProgressBarOptions{Type: "total", Length: 20, InMB: true, Off: true}, "", t.out)
+
+	shared.ColourFprint(t.out, fmt.Sprintf("Sending text [%d bytes]", len(text)), "yellow")
+	err = t.connectAndSend(ctx)
+	return Result{Finished: t.finished}, err
+}
+
+// Connect to the server, upload the manifest and run the transfer until it ends.
+// Cancelling ctx aborts the transfer and returns ctx.Err().
+func (t *transfer) connectAndSend(ctx context.Context) error {
+	paramQuery := url.Values{}
+	paramQuery.Add("intent", "send")
+	paramQuery.Add("sendername", t.opts.Name)
+
+	conn, err := transport.Dial(ctx, t.opts.Endpoint, paramQuery)
+	if err != nil {
+		return err
 	}
 
 	defer conn.Close()
-	if err := HandleSenderConn(conn); err != nil {
-		fmt.Println(err.Error())
+	stop := transport.InterruptReadsOnCancel(ctx, conn)
+	defer stop()
+
+	if err := t.uploadManifest(conn); err != nil {
+		return err
 	}
 
-	return nil
+	return t.handleConn(ctx, conn)
 }
 
-func HandleSenderConn(conn *websocket.Conn) error {
+// Runs until the connection closes. Cancelling ctx aborts the transfer and returns ctx.Err().
+func (t *transfer) handleConn(ctx context.Context, conn transport.Transport) error {
 	for {
-		_, message, err := conn.ReadMessage()
+		message, err := protocol.Read(conn)
 		if err != nil {
-			if CLOSE_CONN {
-				fmt.Println("Server closed the connection.")
+			if _, ok := err.(*protocol.DecodeError); ok {
+				fmt.Fprintln(t.out, err.Error())
+				continue
+			}
+
+			if ctx.Err() != nil {
+				t.cancelTransfer(conn)
+				return ctx.Err()
+			}
+
+			if t.closeConn {
+				fmt.Fprintln(t.out, "Server closed the connection.")
 				return nil
 			}
 
-			fmt.Println("Connection closed.")
+			fmt.Fprintln(t.out, "Connection closed.")
 			return err
 		}
 
-		switch message[1] {
-		case shared.InitialTypeTransferCode:
-			if len(message) < 3 {
-				// Idk request disconnection or smn
+		switch message := message.(type) {
+		case *protocol.ManifestAck:
+			if message.Chunks != t.manifestKey.Chunks {
+				fmt.Fprintf(t.out, "Server stored %d of %d manifest chunks.\n", message.Chunks, t.manifestKey.Chunks)
+				protocol.RequestCloseConn(conn)
 			}
 
-			unique_code = message[2]
-			fmt.Println("Transfer code is", unique_code)
+		case *protocol.TransferCode:
+			t.transferCode = shared.FormatCode(message.Nameplate, t.codeWords)
+			fmt.Fprintln(t.out, "Transfer code is", t.transferCode)
+			if t.opts.Events.OnCode != nil {
+				t.opts.Events.OnCode(t.transferCode)
+			}
 
-		// TODO: If id not found, reply ...
-		case shared.InitialTypeStartTransferWithId:
-			var fileId uint8 = message[2]
-			fileFound := false
-			for _, beingSentFile := range *filesBeingSent {
-				if beingSentFile.Id == fileId {
-					CurrFileBeingSent = &beingSentFile
-					file, err := os.Open(beingSentFile.AbsPath)
-					if err != nil {
-						// Abort operation?
-						fmt.Println("Err opening file...")
-						continue
-					}
-
-					progressBar.UpdateOngoingForNewFile(int(beingSentFile.Size))
-					currFileSingleBlip = int(beingSentFile.Size) / 20
-					sendBuf = make([]byte, chunkSize)
-					activeFileBeingSent = file
-					fileFound = true
+			t.pake, err = secure.NewSpake2(secure.RoleSender, []byte(t.transferCode))
+			if err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				protocol.RequestCloseConn(conn)
+				continue
+			}
+
+			// Held by the server until the receiver connects.
+			if err := protocol.Write(conn, &protocol.PakeMessage{Element: t.pake.Message()}); err != nil {
+				fmt.Fprintln(t.out, "E:Sending key exchange message. Forcing disconnect.\n", err.Error())
+				_ = conn.Close()
+				return err
+			}
+
+		case *protocol.PakeMessage:
+			if t.pake == nil {
+				continue
+			}
+
+			key, err := t.pake.Finish(message.Element)
+			if err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				t.abortTransfer(conn)
+				continue
+			}
+
+			t.channel, err = secure.NewChannel(key, secure.RoleSender)
+			if err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				t.abortTransfer(conn)
+				continue
+			}
+
+			if err := protocol.Write(conn, &protocol.PakeConfirm{Confirmation: t.channel.Confirmation()}); err != nil {
+				fmt.Fprintln(t.out, "E:Sending key confirmation. Forcing disconnect.\n", err.Error())
+				_ = conn.Close()
+				return err
+			}
+
+		case *protocol.PakeConfirm:
+			if t.channel == nil || !t.channel.VerifyConfirmation(message.Confirmation) {
+				fmt.Fprintln(t.out, "Key confirmation failed. The receiver entered the wrong code.")
+				t.abortTransfer(conn)
+				continue
+			}
+
+			t.channelVerified = true
+			shared.ColourFprint(t.out, "Secure channel established.", "green")
+
+			metadata, err := protocol.SealReceiverMD(t.channel, t.manifestKey)
+			if err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				t.abortTransfer(conn)
+				continue
+			}
+
+			if err := protocol.Write(conn, metadata); err != nil {
+				fmt.Fprintln(t.out, "E:Sending metadata. Forcing disconnect.\n", err.Error())
+				_ = conn.Close()
+				return err
+			}
+
+			// The text went with the metadata, that is the whole transfer.
+			if t.manifestKey.Kind == shared.ContentKindText {
+				shared.ColourFprint(t.out, "Text delivered.", "green")
+				if err := t.sendAllTransferFinishIfDone(conn); err != nil {
+					return err
 				}
 			}
 
-			if !fileFound {
-				fmt.Println("File not found, id", fileId)
+		// TODO: If id not found, reply ...
+		case *protocol.StartTransferWithId:
+			if !t.channelVerified {
+				fmt.Fprintln(t.out, "Receiver requested a file before the key exchange finished.")
+				continue
+			}
+
+			if err := t.openFileForSending(message.Id, 0); err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				continue
+			}
+
+		case *protocol.StartArchive:
+			if !t.channelVerified || !t.manifestKey.Archive {
+				continue
+			}
+
+			if err := t.openArchiveForSending(message.Ids); err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				continue
+			}
+
+		case *protocol.StartTransferWithIdAtOffset:
+			if !t.channelVerified {
+				fmt.Fprintln(t.out, "Receiver requested a file before the key exchange finished.")
+				continue
+			}
 
-			} else {
-				if err := SendNextPacket(conn); err != nil {
-					fmt.Println("Could not send file chunk.", err.Error())
-					continue
+			if err := t.openFileForSending(message.Id, message.Offset); err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				continue
+			}
+
+		case *protocol.SelectFiles:
+			if !t.channelVerified {
+				continue
+			}
+
+			selected := make(map[uint32]bool, len(message.Ids))
+			for _, id := range message.Ids {
+				selected[id] = true
+			}
+
+			// Files left out are not sent and do not count towards the progress.
+			selectedSize := 0
+			for _, file := range t.files {
+				if selected[file.Id] {
+					selectedSize += int(file.Size)
+				} else {
+					t.fileIdsSent[file.Id] = true
 				}
 			}
 
-		case shared.InitialTypeRequestNextPacket:
-			if err := SendNextPacket(conn); err != nil {
-				fmt.Println("Could not send file chunk.", err.Error())
+			t.progressBar.SetTotalSize(selectedSize)
+			t.progressBar.PrintAbove(fmt.Sprintf("Receiver selected %d of %d files.", len(selected), len(t.files)))
+
+		case *protocol.UseCodec:
+			if !t.channelVerified {
 				continue
 			}
 
-		case shared.InitialTypeTextMessage:
-			if len(message) > 2 {
-				fmt.Printf("%s %s\n", shared.ColourSprintf("Server:", "cyan", false), string(message[2:]))
+			if !slices.Contains(t.opts.Codecs, message.Codec) {
+				fmt.Fprintf(t.out, "Receiver picked codec %d, which was not offered. Sending uncompressed.\n", message.Codec)
+				message.Codec = shared.CodecNone
+			}
+
+			t.compressor = shared.NewCompressor(message.Codec)
+
+		case *protocol.SkipFile:
+			if !t.channelVerified || message.Id == 0 || int(message.Id) > len(t.files) {
+				continue
+			}
+
+			skippedFile := &t.files[message.Id-1]
+			t.progressBar.PrintAbove(fmt.Sprintf("Receiver skipped %s", skippedFile.RelativePath))
+			t.progressBar.UpdateTransferredSize(int(skippedFile.Size))
+			t.fileIdsSent[skippedFile.Id] = true
+
+			if err := t.sendAllTransferFinishIfDone(conn); err != nil {
+				return err
+			}
+
+		// The server keeps the transfer open for the receiver to reconnect with the same code.
+		// It gets a fresh key exchange and resumes from what it already has on disk.
+		case *protocol.ReceiverDisconnected:
+			// It got our confirmation, enough to check its guess at the code, without proving it knew the code.
+			// Another key exchange would give it another guess.
+			if t.channel != nil && !t.channelVerified {
+				fmt.Fprintln(t.out, "Receiver disconnected before confirming the code. Aborting, send again for a new code.")
+				t.abortTransfer(conn)
+				continue
+			}
+
+			t.progressBar.PrintAbove("Receiver disconnected. Waiting for it to reconnect.")
+
+			if t.activeFileBeingSent != nil {
+				_ = t.activeFileBeingSent.Close()
+				t.activeFileBeingSent = nil
+				t.activeArchive = nil
+			}
+
+			t.progressBar.RewindOngoing()
+			t.credits = 0
+			t.compressor = shared.NewCompressor(shared.CodecNone)
+			t.channel = nil
+			t.channelVerified = false
+
+			t.pake, err = secure.NewSpake2(secure.RoleSender, []byte(t.transferCode))
+			if err != nil {
+				fmt.Fprintln(t.out, err.Error())
+				protocol.RequestCloseConn(conn)
+				continue
+			}
+
+			if err := protocol.Write(conn, &protocol.PakeMessage{Element: t.pake.Message()}); err != nil {
+				fmt.Fprintln(t.out, "E:Sending key exchange message. Forcing disconnect.\n", err.Error())
+				_ = conn.Close()
+				return err
+			}
+
+		case *protocol.GrantCredit:
+			if !t.channelVerified || t.activeFileBeingSent == nil {
+				continue
+			}
+
+			// Stream until the credit runs out or the file ends, without waiting on the receiver.
+			t.credits += message.Credits
+			for t.credits > 0 && t.activeFileBeingSent != nil && ctx.Err() == nil {
+				t.credits--
+				if err := t.sendNextPacket(conn); err != nil {
+					fmt.Fprintln(t.out, "Could not send file chunk.", err.Error())
+					break
+				}
+			}
+
+		case *protocol.TextMessage:
+			if message.Text != "" {
+				fmt.Fprintf(t.out, "%s %s\n", shared.ColourSprintf("Server:", "cyan", false), message.Text)
 			}
 
 		// Only used to toggle this flag, which doesnt throw error when conn is closed.
-		case shared.InitialTypeCloseConnNotify:
-			CLOSE_CONN = true
+		case *protocol.CloseConnNotify:
+			t.closeConn = true
+		}
+
+	}
+}
+
+// Upload the sealed manifest to the server, which issues the transfer code once it has all of it.
+func (t *transfer) uploadManifest(conn transport.Transport) error {
+	for _, chunk := range t.manifestChunks {
+		if err := protocol.Write(conn, chunk); err != nil {
+			return fmt.Errorf("E:Uploading manifest. %s", err.Error())
 		}
+	}
 
+	if err := protocol.Write(conn, &protocol.ManifestEnd{Chunks: t.manifestKey.Chunks}); err != nil {
+		return fmt.Errorf("E:Uploading manifest. %s", err.Error())
 	}
+
+	return nil
 }
 
-func SendNextPacket(conn *websocket.Conn) error {
-	fileBytes, isEOF, err := GetNextFileBytes()
+func (t *transfer) sendNextPacket(conn transport.Transport) error {
+	fileBytes, isEOF, err := t.getNextFileBytes()
 	if err != nil {
-		// Abort?
-		fmt.Println("E:Reading file.", err.Error())
+		// The receiver cannot get the rest of it.
+		fmt.Fprintln(t.out, "E:Reading file.", err.Error())
+		_ = t.activeFileBeingSent.Close()
+		t.activeFileBeingSent = nil
+		t.abortTransfer(conn)
+		return nil
 	}
 
 	if isEOF {
-		progressBar.PrintPostDoneMessage(fmt.Sprintf("Finished uploading file %s", CurrFileBeingSent.RelativePath))
-		FileIdsSent = append(FileIdsSent, CurrFileBeingSent.Id)
-		transferStarted = false
+		t.progressBar.PrintPostDoneMessage(fmt.Sprintf("Finished uploading file %s", t.currFileBeingSent.RelativePath))
+		_ = t.activeFileBeingSent.Close()
+		t.activeFileBeingSent = nil
+		// Left over credit was granted for this file.
+		t.credits = 0
+
+		finish := &protocol.SingleFileTransferFinish{}
+		if t.currFileBeingSent.SizeUnknown {
+			finish.SealedHash = t.channel.Seal([]byte(hex.EncodeToString(t.streamHasher.Sum(nil))))
+		}
+
+		// The receiver asked for everything it still wanted in the archive.
+		// The archive itself is not in the manifest, so it is not counted.
+		if t.activeArchive != nil {
+			for _, file := range t.files {
+				t.fileIdsSent[file.Id] = true
+			}
 
-		currFileTransferDonePkt, _ := shared.CreateBinaryPacket(shared.Version, shared.InitialTypeSingleFileTransferFinish)
-		if err := conn.WriteMessage(websocket.BinaryMessage, currFileTransferDonePkt); err != nil {
-			fmt.Println("E:Sending single file transfer finish ping. Forcing disconnect.\n", err.Error())
+			t.activeArchive = nil
+		} else {
+			// A resumed transfer can ask for a file again.
+			t.fileIdsSent[t.currFileBeingSent.Id] = true
+		}
+
+		if err := protocol.Write(conn, finish); err != nil {
+			fmt.Fprintln(t.out, "E:Sending single file transfer finish ping. Forcing disconnect.\n", err.Error())
 			_ = conn.Close()
 			return err
 		}
 
-		// If all files transferred
-		if len(FileIdsSent) == len(*filesBeingSent) {
-			fmt.Println()
-			allFilesTransferPkt, _ := shared.CreateBinaryPacket(shared.Version, shared.InitialTypeAllTransferFinish)
-			if err := conn.WriteMessage(websocket.BinaryMessage, allFilesTransferPkt); err != nil {
-				fmt.Println("E:Sending single file transfer finish ping. Forcing disconnect.\n", err.Error())
-				_ = conn.Close()
-				return err
-			}
+		return t.sendAllTransferFinishIfDone(conn)
+	}
+
+	if t.currFileBeingSent.SizeUnknown {
+		t.streamHasher.Write(fileBytes)
+	}
+
+	// Archives count the file contents in them, not the tar headers.
+	sentSize := len(fileBytes)
+	if t.activeArchive != nil {
+		sentSize = t.activeArchive.takeContentRead()
+	}
+
+	t.progressBar.UpdateTransferredSize(sentSize)
+	t.progressBar.Show()
+
+	// Files that look compressed already are sent as is, going by the first chunk.
+	if !t.activeFileSampled {
+		t.activeFileSampled = true
+		if shared.LooksIncompressible(fileBytes) {
+			t.compressActiveFile = false
 		}
+	}
 
-		return nil
+	packet := &protocol.TransferPacket{Timestamp: time.Now().UnixMilli()}
+	if t.compressActiveFile {
+		if compressed, ok := t.compressor.Compress(fileBytes); ok {
+			packet.Flags |= shared.PacketFlagCompressed
+			fileBytes = compressed
+		}
 	}
 
-	progressBar.UpdateTransferredSize(len(fileBytes))
-	progressBar.Show()
+	packet.Data = t.channel.Seal(fileBytes)
+	if err := protocol.Write(conn, packet); err != nil {
+		fmt.Fprintln(t.out, "E:Sending file packet. Forcing disconnect.\n", err.Error())
+		_ = conn.Close()
+		return err
+	}
 
-	// Refer to shared.Packet
-	// [Version 1byte][Init_byte 1byte][timestamp int64][datachunk...]
-	fileDataPacket, err = shared.CreateBinaryPacket(shared.Version, shared.InitialTypeTransferPacket, time.Now().UnixMilli(), fileBytes)
-	if err != nil {
-		fmt.Println("Could not create filebytes packet...")
+	return nil
+}
+
+// Tell the receiver the transfer is done once every file was sent or skipped.
+func (t *transfer) sendAllTransferFinishIfDone(conn transport.Transport) error {
+	if len(t.fileIdsSent) != len(t.files) {
 		return nil
 	}
 
-	if err := conn.WriteMessage(websocket.BinaryMessage, fileDataPacket); err != nil {
-		fmt.Println("E:Sending file packet. Forcing disconnect.\n", err.Error())
+	fmt.Fprintln(t.out)
+	if err := protocol.Write(conn, &protocol.AllTransferFinish{}); err != nil {
+		fmt.Fprintln(t.out, "E:Sending all transfer finish ping. Forcing disconnect.\n", err.Error())
 		_ = conn.Close()
 		return err
 	}
 
+	t.finished = true
 	return nil
 }
 
-func GetNextFileBytes() ([]byte, bool, error) {
+// Open the file with fileId and seek to offset, for the receiver to resume from.
+func (t *transfer) openFileForSending(fileId uint32, offset uint64) error {
+	// Ids count up from 1 in order.
+	if fileId == 0 || int(fileId) > len(t.files) {
+		return fmt.Errorf("File not found, id %d", fileId)
+	}
+
+	beingSentFile := &t.files[fileId-1]
+	if beingSentFile.Type != shared.EntryTypeFile {
+		return fmt.Errorf("Receiver requested %s, which is not a file.", beingSentFile.RelativePath)
+	}
+
+	file, err := t.openForSending(beingSentFile, offset)
+	if err != nil {
+		return err
+	}
+
+	t.setActiveFile(beingSentFile, file)
+	t.progressBar.UpdateOngoingForNewFile(int(beingSentFile.Size))
+	t.progressBar.UpdateTransferredSize(int(offset))
+	return nil
+}
+
+// Start sending the files with the given ids as one archive.
+func (t *transfer) openArchiveForSending(ids []uint32) error {
+	files := make([]*shared.FileInfo, 0, len(ids))
+	archiveSize := 0
+	for _, id := range ids {
+		if id == 0 || int(id) > len(t.files) {
+			return fmt.Errorf("File not found, id %d", id)
+		}
+
+		file := &t.files[id-1]
+		if file.Type != shared.EntryTypeFile {
+			continue
+		}
+
+		files = append(files, file)
+		archiveSize += int(file.Size)
+	}
+
+	archive := newArchiveReader(files)
+	t.setActiveFile(&shared.FileInfo{Name: "archive", RelativePath: fmt.Sprintf("archive of %d files", len(files))}, archive)
+	t.activeArchive = archive
+	t.progressBar.UpdateOngoingForNewFile(archiveSize)
+	return nil
+}
+
+// Make file the one chunks are read from, closing the previous one.
+func (t *transfer) setActiveFile(beingSentFile *shared.FileInfo, file io.ReadCloser) {
+	if t.activeFileBeingSent != nil {
+		_ = t.activeFileBeingSent.Close()
+	}
+
+	t.currFileBeingSent = beingSentFile
+	t.activeFileBeingSent = file
+	t.activeArchive = nil
+	t.credits = 0
+	t.compressActiveFile = !shared.HasCompressedExtension(beingSentFile.Name)
+	t.activeFileSampled = false
+	if t.sendBuf == nil {
+		t.sendBuf = make([]byte, t.opts.ChunkSize)
+	}
+}
+
+func (t *transfer) openForSending(beingSentFile *shared.FileInfo, offset uint64) (*os.File, error) {
+	// Streams are read once, from the start.
+	if beingSentFile.SizeUnknown {
+		if t.stdinOpened || offset > 0 {
+			return nil, fmt.Errorf("Receiver requested stdin again. It can only be sent once.")
+		}
+
+		t.stdinOpened = true
+		t.streamHasher = sha256.New()
+		return os.Stdin, nil
+	}
+
+	if offset > beingSentFile.Size {
+		return nil, fmt.Errorf("Receiver requested %s from offset %d, past its size.", beingSentFile.RelativePath, offset)
+	}
+
+	file, err := os.Open(beingSentFile.AbsPath)
+	if err != nil {
+		return nil, fmt.Errorf("E:Opening file. %s", err.Error())
+	}
+
+	if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("E:Seeking file. %s", err.Error())
+	}
+
+	return file, nil
+}
+
+// Abort the transfer for a cancelled ctx, so the receiver is not left waiting, and close the connection.
+func (t *transfer) cancelTransfer(conn transport.Transport) {
+	fmt.Fprintln(t.out, "\nTransfer cancelled.")
+	if t.activeFileBeingSent != nil {
+		_ = t.activeFileBeingSent.Close()
+		t.activeFileBeingSent = nil
+		t.activeArchive = nil
+	}
+
+	t.abortTransfer(conn)
+	_ = conn.Close()
+}
+
+// Ask the server to abort the transfer, which closes both connections.
+func (t *transfer) abortTransfer(conn transport.Transport) {
+	if err := protocol.Write(conn, &protocol.AbortTransfer{}); err != nil {
+		fmt.Fprintln(t.out, "E:Aborting transfer. Forcing disconnect.\n", err.Error())
+		_ = conn.Close()
+	}
+}
+
+func (t *transfer) getNextFileBytes() ([]byte, bool, error) {
 	// Reads len(buf) -> 1024 bytes and stores them into buf itself
-	n, err := activeFileBeingSent.Read(sendBuf)
+	n, err := t.activeFileBeingSent.Read(t.sendBuf)
 	if err != nil {
 		if err == io.EOF {
 			return nil, true, nil
@@ -242,5 +746,5 @@ func GetNextFileBytes() ([]byte, bool, error) {
 		return nil, true, nil
 	}
 
-	return sendBuf[:n], false, nil
+	return t.sendBuf[:n], false, nil
 }
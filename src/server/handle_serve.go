@@ -0,0 +1,220 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/apooravm/tshare-client/src/protocol"
+	"github.com/apooravm/tshare-client/src/transport"
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Clients are CLIs, not browsers.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Start the relay on addr. Clients connect to ws://<addr>/api/share.
+// If tcpAddr is set, it also takes raw TCP connections there, at tcp://<tcpAddr>.
+func HandleServeArg(addr, tcpAddr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/share", HandleShare)
+
+	if tcpAddr != "" {
+		listener, err := net.Listen("tcp", tcpAddr)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Relay listening for TCP on %s. Clients can connect with '-endpoint=tcp://<host>%s'\n", tcpAddr, tcpAddr)
+		go serveTCP(listener)
+	}
+
+	fmt.Printf("Relay listening on %s. Clients can connect with '-endpoint=ws://<host>%s/api/share'\n", addr, addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func HandleShare(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("E:Upgrading connection.", err.Error())
+		return
+	}
+
+	ServeTransport(transport.NewWebSocket(conn), r.URL.Query())
+}
+
+func serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("E:Accepting TCP connection.", err.Error())
+			return
+		}
+
+		go func() {
+			t, query, err := transport.AcceptTCP(conn)
+			if err != nil {
+				log.Println("E:Reading TCP handshake.", err.Error())
+				_ = conn.Close()
+				return
+			}
+
+			ServeTransport(t, query)
+		}()
+	}
+}
+
+// Run the relay side of a client connected over conn, until it disconnects.
+// query carries the intent and name of the client, and the nameplate to join for receivers.
+func ServeTransport(conn transport.Transport, query url.Values) {
+	switch query.Get("intent") {
+	case "send":
+		handleSender(conn, query.Get("sendername"))
+
+	case "receive":
+		handleReceiver(conn, query.Get("receivername"), query.Get("nameplate"))
+
+	default:
+		client := &Client{Conn: conn}
+		_ = client.WriteText("Invalid intent. Must be send/receive.")
+		client.NotifyAndClose()
+	}
+}
+
+func handleSender(conn transport.Transport, name string) {
+	client := &Client{Conn: conn, Name: name}
+
+	session, err := NewSession(client)
+	if err != nil {
+		_ = client.WriteText(err.Error())
+		client.NotifyAndClose()
+		return
+	}
+
+	log.Printf("Session %d created by %s.\n", session.Nameplate, name)
+
+	// The code is only issued once the manifest is stored, so a receiver never joins before it.
+	chunks, err := session.ReceiveManifest()
+	if err != nil {
+		session.Close(err.Error())
+		return
+	}
+
+	if err := client.Send(&protocol.ManifestAck{Chunks: chunks}); err != nil {
+		session.Close("")
+		return
+	}
+
+	if err := client.Send(&protocol.TransferCode{Nameplate: session.Nameplate}); err != nil {
+		session.Close("")
+		return
+	}
+
+	_ = client.WriteText("Waiting for receiver to connect.")
+
+	for {
+		frame, err := conn.ReadMessage()
+		if err != nil {
+			session.Close("Sender disconnected.")
+			return
+		}
+
+		message, err := protocol.Decode(frame)
+		if err != nil {
+			_ = client.WriteText(err.Error())
+			continue
+		}
+
+		switch message.(type) {
+		// Forwarded as is to the receiver.
+		case *protocol.PakeMessage:
+			if err := session.ForwardToReceiver(frame, true); err != nil {
+				session.DetachReceiver(session.Peer(client))
+			}
+
+		case *protocol.PakeConfirm, *protocol.ReceiverMD,
+			*protocol.TransferPacket, *protocol.SingleFileTransferFinish:
+			if err := session.ForwardToReceiver(frame, false); err != nil {
+				session.DetachReceiver(session.Peer(client))
+			}
+
+		case *protocol.AllTransferFinish:
+			_ = session.ForwardToReceiver(frame, false)
+
+			log.Printf("Session %d finished.\n", session.Nameplate)
+			session.Close("Transfer complete.")
+			return
+
+		case *protocol.AbortTransfer:
+			session.Close("Sender aborted the transfer.")
+			return
+
+		case *protocol.CloseConn:
+			session.Close("Sender closed the connection.")
+			return
+		}
+	}
+}
+
+func handleReceiver(conn transport.Transport, name string, rawNameplate string) {
+	client := &Client{Conn: conn, Name: name}
+
+	nameplate, err := strconv.ParseUint(rawNameplate, 10, 16)
+	if err != nil {
+		_ = client.WriteText("Invalid transfer code.")
+		client.NotifyAndClose()
+		return
+	}
+
+	session, err := JoinSession(uint16(nameplate), client)
+	if err != nil {
+		_ = client.WriteText(err.Error())
+		client.NotifyAndClose()
+		return
+	}
+
+	log.Printf("Session %d joined by %s.\n", session.Nameplate, name)
+
+	_ = session.Sender.WriteText(fmt.Sprintf("%s connected.", name))
+
+	for {
+		frame, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("Session %d lost its receiver. Waiting for it to reconnect.\n", session.Nameplate)
+			session.DetachReceiver(client)
+			return
+		}
+
+		message, err := protocol.Decode(frame)
+		if err != nil {
+			_ = client.WriteText(err.Error())
+			continue
+		}
+
+		switch message.(type) {
+		// Forwarded as is to the sender.
+		case *protocol.PakeMessage, *protocol.PakeConfirm, *protocol.StartTransferWithId,
+			*protocol.StartTransferWithIdAtOffset, *protocol.SkipFile, *protocol.SelectFiles, *protocol.UseCodec,
+			*protocol.StartArchive, *protocol.GrantCredit:
+			if err := session.Sender.Write(frame); err != nil {
+				session.Close("Sender disconnected.")
+				return
+			}
+
+		case *protocol.ReceiverAbort, *protocol.AbortTransfer:
+			session.Close("Receiver aborted the transfer.")
+			return
+
+		case *protocol.CloseConn:
+			session.Close("Receiver closed the connection.")
+			return
+		}
+	}
+}
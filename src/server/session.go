@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/apooravm/tshare-client/src/protocol"
+	"github.com/apooravm/tshare-client/src/transport"
+)
+
+// How long a session waits for a dropped receiver to reconnect before closing.
+const ResumeTimeout = 10 * time.Minute
+
+var (
+	// Keyed by nameplate.
+	sessions   = make(map[uint16]*Session)
+	sessionsMu sync.Mutex
+)
+
+// A connected sender or receiver.
+// Transports allow only one concurrent writer, and both the client's own
+// handler and its peer's handler write to it, so writes go through the mutex.
+type Client struct {
+	Conn transport.Transport
+	Name string
+	mu   sync.Mutex
+}
+
+// Write an already encoded frame. Used to forward frames between peers.
+func (c *Client) Write(frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.Conn.WriteMessage(frame)
+}
+
+func (c *Client) Send(m protocol.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return protocol.Write(c.Conn, m)
+}
+
+// Send a text message which the client prints prefixed with "Server:".
+func (c *Client) WriteText(message string) error {
+	return c.Send(&protocol.TextMessage{Text: message})
+}
+
+// Notify the client that the connection is about to be closed and close it.
+// The client treats the following read error as a graceful disconnect.
+func (c *Client) NotifyAndClose() {
+	_ = c.Send(&protocol.CloseConnNotify{})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.Conn.Close()
+}
+
+// A single transfer. Created when a sender connects and identified by its nameplate.
+// The server never sees file metadata or contents, only sealed payloads it forwards.
+// It also never sees the words of the transfer code, which key the encryption.
+type Session struct {
+	Nameplate uint16
+	Sender    *Client
+	Receiver  *Client
+
+	mu     sync.Mutex
+	closed bool
+	// Sealed manifest frames uploaded by the sender. Sent to every receiver that joins.
+	manifest [][]byte
+	// Key exchange frames from the sender held until the receiver connects.
+	pending [][]byte
+	// Closes the session if a dropped receiver does not come back.
+	resumeTimer *time.Timer
+}
+
+// Register a new session for the sender under the lowest free nameplate, keeping codes short.
+// Nameplates need not be secret, guessing one only gets a single try at the code words.
+func NewSession(sender *Client) (*Session, error) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	for nameplate := 1; nameplate <= math.MaxUint16; nameplate++ {
+		if _, ok := sessions[uint16(nameplate)]; ok {
+			continue
+		}
+
+		session := &Session{
+			Nameplate: uint16(nameplate),
+			Sender:    sender,
+		}
+		sessions[session.Nameplate] = session
+		return session, nil
+	}
+
+	return nil, fmt.Errorf("All transfer codes are in use. Try again later.")
+}
+
+// Attach a receiver to the session waiting under nameplate.
+func JoinSession(nameplate uint16, receiver *Client) (*Session, error) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	session, ok := sessions[nameplate]
+	if !ok {
+		return nil, fmt.Errorf("No transfer found with code %d.", nameplate)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.Receiver != nil {
+		return nil, fmt.Errorf("Transfer %d already has a receiver.", nameplate)
+	}
+
+	// Flushed under the lock so frames forwarded right after joining cannot overtake them.
+	// The receiver is only attached once it got them, a dead one would keep the next from joining.
+	for _, frame := range append(session.manifest, session.pending...) {
+		if err := receiver.Write(frame); err != nil {
+			return nil, err
+		}
+	}
+
+	session.Receiver = receiver
+	session.pending = nil
+	if session.resumeTimer != nil {
+		session.resumeTimer.Stop()
+		session.resumeTimer = nil
+	}
+
+	return session, nil
+}
+
+// Receive the sealed manifest from the sender, up to its ManifestEnd.
+// Returns the number of chunks stored.
+func (s *Session) ReceiveManifest() (uint32, error) {
+	size := 0
+	for {
+		frame, err := s.Sender.Conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		message, err := protocol.Decode(frame)
+		if err != nil {
+			return 0, err
+		}
+
+		switch message := message.(type) {
+		case *protocol.ManifestChunk:
+			size += len(frame)
+			if size > protocol.MaxManifestSize {
+				return 0, fmt.Errorf("Manifest too large. At most %dMB.", protocol.MaxManifestSize/(1024*1024))
+			}
+
+			s.mu.Lock()
+			s.manifest = append(s.manifest, frame)
+			s.mu.Unlock()
+
+		case *protocol.ManifestEnd:
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			if message.Chunks != uint32(len(s.manifest)) || len(s.manifest) == 0 {
+				return 0, fmt.Errorf("Manifest incomplete. Got %d of %d chunks.", len(s.manifest), message.Chunks)
+			}
+
+			return message.Chunks, nil
+
+		default:
+			return 0, fmt.Errorf("Expected the manifest, got message type 0x%02x.", message.Type())
+		}
+	}
+}
+
+// Forward a frame from the sender to the receiver.
+// If the receiver is not connected, the frame is held when hold is set and dropped otherwise.
+// Only key exchange frames are held, anything else is stale by the time a receiver (re)connects.
+func (s *Session) ForwardToReceiver(frame []byte, hold bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Receiver == nil {
+		if hold {
+			s.pending = append(s.pending, frame)
+		}
+
+		return nil
+	}
+
+	return s.Receiver.Write(frame)
+}
+
+// Remove a receiver that dropped without aborting, so it can reconnect with the same code and resume.
+// The sender is notified and restarts the key exchange for the next receiver,
+// or aborts if the receiver never confirmed the code.
+func (s *Session) DetachReceiver(receiver *Client) {
+	s.mu.Lock()
+	if s.closed || s.Receiver != receiver {
+		s.mu.Unlock()
+		return
+	}
+
+	s.Receiver = nil
+	s.pending = nil
+	s.resumeTimer = time.AfterFunc(ResumeTimeout, func() {
+		s.Close("Receiver did not reconnect in time.")
+	})
+	s.mu.Unlock()
+
+	if err := s.Sender.Send(&protocol.ReceiverDisconnected{}); err != nil {
+		s.Close("")
+	}
+}
+
+// Get the other side of the transfer. nil if the receiver has not joined yet.
+func (s *Session) Peer(client *Client) *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if client == s.Sender {
+		return s.Receiver
+	}
+
+	return s.Sender
+}
+
+// End the session, notifying and closing both clients.
+// reason, if not empty, is sent to both clients as a text message first.
+func (s *Session) Close(reason string) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+
+	s.closed = true
+	clients := []*Client{s.Sender, s.Receiver}
+	if s.resumeTimer != nil {
+		s.resumeTimer.Stop()
+	}
+	s.mu.Unlock()
+
+	sessionsMu.Lock()
+	if sessions[s.Nameplate] == s {
+		delete(sessions, s.Nameplate)
+	}
+	sessionsMu.Unlock()
+
+	for _, client := range clients {
+		if client == nil {
+			continue
+		}
+
+		if reason != "" {
+			_ = client.WriteText(reason)
+		}
+
+		client.NotifyAndClose()
+	}
+}
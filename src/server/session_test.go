@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/apooravm/tshare-client/src/transport"
+)
+
+// More frames than a pipe holds, so the flush blocks on a receiver that stops reading.
+const manifestFrames = 300
+
+func TestJoinAfterReceiverDiesDuringFlush(t *testing.T) {
+	senderConn, _ := transport.Pipe()
+	session, err := NewSession(&Client{Conn: senderConn, Name: "Sender"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close("")
+
+	for i := 0; i < manifestFrames; i++ {
+		session.manifest = append(session.manifest, []byte(fmt.Sprintf("chunk %d", i)))
+	}
+	session.pending = [][]byte{[]byte("pake")}
+
+	// Reads one frame and hangs up in the middle of the flush.
+	deadConn, deadPeer := transport.Pipe()
+	go func() {
+		_, _ = deadPeer.ReadMessage()
+		_ = deadPeer.Close()
+	}()
+
+	if _, err := JoinSession(session.Nameplate, &Client{Conn: deadConn, Name: "Dead"}); err == nil {
+		t.Fatal("Joined with a closed receiver.")
+	}
+
+	if session.Receiver != nil {
+		t.Fatal("Closed receiver left attached to the session.")
+	}
+
+	conn, peer := transport.Pipe()
+	received := make(chan int)
+	go func() {
+		count := 0
+		for ; count < manifestFrames+1; count++ {
+			if _, err := peer.ReadMessage(); err != nil {
+				break
+			}
+		}
+		received <- count
+	}()
+
+	receiver := &Client{Conn: conn, Name: "Receiver"}
+	if _, err := JoinSession(session.Nameplate, receiver); err != nil {
+		t.Fatal("Second receiver could not join.", err)
+	}
+
+	if session.Receiver != receiver {
+		t.Fatal("Second receiver not attached to the session.")
+	}
+
+	select {
+	case count := <-received:
+		if count != manifestFrames+1 {
+			t.Fatalf("Got %d frames, expected the manifest and the held key exchange, %d.", count, manifestFrames+1)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Flush did not finish.")
+	}
+}
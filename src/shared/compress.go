@@ -0,0 +1,148 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Codecs transfer packets can be compressed with.
+const (
+	CodecNone = uint8(0)
+	CodecGzip = uint8(1)
+)
+
+// Codec names for -compress.
+var CodecNames = map[string]uint8{
+	"none": CodecNone,
+	"gzip": CodecGzip,
+}
+
+// Codecs to offer or accept for a codec name from CodecNames. Uncompressed is always fine.
+func OfferedCodecs(name string) []uint8 {
+	codec := CodecNames[name]
+	if codec == CodecNone {
+		return []uint8{CodecNone}
+	}
+
+	return []uint8{codec, CodecNone}
+}
+
+// Set in the flags of a transfer packet whose chunk was compressed with the negotiated codec.
+const PacketFlagCompressed = uint8(1)
+
+// Max size a single chunk may decompress to, so a crafted chunk cannot expand without end.
+const MaxDecompressedChunkSize = 64 * 1024 * 1024
+
+// Files whose sampled contents have more bits per byte than this are sent as is.
+// Text is around 4 to 5, compressed and encrypted data close to 8.
+const maxCompressibleEntropy = 7.5
+
+// Bytes of a file the entropy is estimated from.
+const entropySampleSize = 64 * 1024
+
+// Formats that are compressed already.
+var compressedExtensions = []string{
+	".7z", ".aac", ".apk", ".avi", ".br", ".bz2", ".docx", ".flac", ".gif", ".gz", ".heic", ".jar",
+	".jpeg", ".jpg", ".lz4", ".m4a", ".mkv", ".mov", ".mp3", ".mp4", ".ogg", ".opus", ".png", ".pptx",
+	".rar", ".tgz", ".webm", ".webp", ".woff", ".woff2", ".xlsx", ".xz", ".zip", ".zst",
+}
+
+// Whether a file with this name is compressed already, going by its extension.
+func HasCompressedExtension(name string) bool {
+	return slices.Contains(compressedExtensions, strings.ToLower(path.Ext(name)))
+}
+
+// Whether a sample of the contents looks too random to compress, like compressed or encrypted data.
+func LooksIncompressible(sample []byte) bool {
+	sample = sample[:min(len(sample), entropySampleSize)]
+	if len(sample) == 0 {
+		return false
+	}
+
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+
+	// Shannon entropy in bits per byte.
+	entropy := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+
+		p := float64(count) / float64(len(sample))
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy > maxCompressibleEntropy
+}
+
+// Compresses chunks with a codec, reusing its buffers between chunks.
+type Compressor struct {
+	codec uint8
+	buf   bytes.Buffer
+	gzip  *gzip.Writer
+}
+
+func NewCompressor(codec uint8) *Compressor {
+	return &Compressor{codec: codec}
+}
+
+// Compress the chunk. Returns false if the codec is none or the chunk did not get smaller,
+// in which case it should be sent as is. The returned slice is only valid until the next call.
+func (c *Compressor) Compress(chunk []byte) ([]byte, bool) {
+	if c.codec != CodecGzip {
+		return nil, false
+	}
+
+	c.buf.Reset()
+	if c.gzip == nil {
+		c.gzip, _ = gzip.NewWriterLevel(&c.buf, gzip.BestSpeed)
+	} else {
+		c.gzip.Reset(&c.buf)
+	}
+
+	if _, err := c.gzip.Write(chunk); err != nil {
+		return nil, false
+	}
+
+	if err := c.gzip.Close(); err != nil {
+		return nil, false
+	}
+
+	if c.buf.Len() >= len(chunk) {
+		return nil, false
+	}
+
+	return c.buf.Bytes(), true
+}
+
+// Decompress a chunk compressed with codec.
+func Decompress(codec uint8, chunk []byte) ([]byte, error) {
+	if codec != CodecGzip {
+		return nil, fmt.Errorf("E:Compressed chunk, but no codec was agreed on.")
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(chunk))
+	if err != nil {
+		return nil, fmt.Errorf("E:Decompressing chunk. %s", err.Error())
+	}
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, MaxDecompressedChunkSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("E:Decompressing chunk. %s", err.Error())
+	}
+
+	if len(decompressed) > MaxDecompressedChunkSize {
+		return nil, fmt.Errorf("E:Decompressing chunk. Expands past %d bytes.", MaxDecompressedChunkSize)
+	}
+
+	return decompressed, nil
+}
@@ -0,0 +1,161 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"testing"
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	compressor := NewCompressor(CodecGzip)
+	chunks := [][]byte{
+		bytes.Repeat([]byte("tshare compresses text\n"), 4000),
+		bytes.Repeat([]byte{0}, DefaultChunkSize),
+		bytes.Repeat([]byte("a"), 500),
+	}
+
+	// The compressor reuses its buffers, every chunk must come out whole.
+	for _, chunk := range chunks {
+		compressed, ok := compressor.Compress(chunk)
+		if !ok {
+			t.Fatalf("Compress() of %d compressible bytes was not used", len(chunk))
+		}
+
+		if len(compressed) >= len(chunk) {
+			t.Fatalf("Compress() = %d bytes, from %d", len(compressed), len(chunk))
+		}
+
+		decompressed, err := Decompress(CodecGzip, compressed)
+		if err != nil {
+			t.Fatalf("Decompress() = %v", err)
+		}
+
+		if !bytes.Equal(decompressed, chunk) {
+			t.Fatalf("Decompress() = %d bytes, want the %d compressed", len(decompressed), len(chunk))
+		}
+	}
+}
+
+func TestCompressNotSmaller(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec uint8
+		chunk []byte
+	}{
+		{"no codec", CodecNone, bytes.Repeat([]byte("a"), 1000)},
+		{"random", CodecGzip, randomBytes(t, 4096)},
+		{"tiny", CodecGzip, []byte("ab")},
+		{"empty", CodecGzip, []byte{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if compressed, ok := NewCompressor(test.codec).Compress(test.chunk); ok {
+				t.Errorf("Compress() = %d bytes from %d, want the chunk sent as is", len(compressed), len(test.chunk))
+			}
+		})
+	}
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	compressed, ok := NewCompressor(CodecGzip).Compress(bytes.Repeat([]byte("tshare"), 1000))
+	if !ok {
+		t.Fatal("Compress() was not used")
+	}
+
+	// A small chunk expanding past the limit.
+	var bomb bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&bomb, gzip.BestCompression)
+	zeros := make([]byte, 1024*1024)
+	for written := 0; written <= MaxDecompressedChunkSize; written += len(zeros) {
+		if _, err := writer.Write(zeros); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		codec uint8
+		chunk []byte
+	}{
+		{"no codec agreed", CodecNone, bytes.Clone(compressed)},
+		{"not gzip", CodecGzip, []byte("plain text")},
+		{"truncated", CodecGzip, bytes.Clone(compressed[:len(compressed)/2])},
+		{"empty", CodecGzip, []byte{}},
+		{"expands past the limit", CodecGzip, bomb.Bytes()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if decompressed, err := Decompress(test.codec, test.chunk); err == nil {
+				t.Errorf("Decompress() = %d bytes, want an error", len(decompressed))
+			}
+		})
+	}
+}
+
+func TestLooksIncompressible(t *testing.T) {
+	tests := []struct {
+		name   string
+		sample []byte
+		want   bool
+	}{
+		{"empty", nil, false},
+		{"text", bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 1000), false},
+		{"zeros", make([]byte, 4096), false},
+		{"every byte once", func() []byte {
+			b := make([]byte, 256)
+			for i := range b {
+				b[i] = byte(i)
+			}
+			return b
+		}(), true},
+		{"random", randomBytes(t, 64*1024), true},
+		{"random then text past the sample", append(randomBytes(t, entropySampleSize), bytes.Repeat([]byte("a"), 10*entropySampleSize)...), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := LooksIncompressible(test.sample); got != test.want {
+				t.Errorf("LooksIncompressible(%s) = %v, want %v", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestHasCompressedExtension(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"photo.jpg", true},
+		{"PHOTO.JPG", true},
+		{"backup.tar.gz", true},
+		{"notes.txt", false},
+		{"Makefile", false},
+		{"zip", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := HasCompressedExtension(test.name); got != test.want {
+				t.Errorf("HasCompressedExtension(%q) = %v, want %v", test.name, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+package shared
+
+// Hooks for programs running a transfer in process instead of through the CLI. Unset ones are skipped.
+type TransferEvents struct {
+	// The transfer code, once the relay issued it. Sender only.
+	OnCode func(code string)
+	// The files on offer, once the metadata is opened. Receiver only.
+	// Replaces the prompt, the transfer is declined if it returns false.
+	OnManifest func(files []FileInfo) bool
+	// Bytes transferred so far out of the total. The total is 0 for streams.
+	OnProgress func(transferred, total int)
+}
@@ -0,0 +1,167 @@
+package shared
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Ignore files read from every folder of a folder being sent. Same syntax as .gitignore.
+var IgnoreFileNames = []string{".gitignore", ".tshareignore"}
+
+// Decides which files of a folder being sent enter the manifest.
+// Paths are relative to the folder being sent, without its name.
+type FileFilter struct {
+	// Globs from -exclude. Matching files and folders are left out.
+	Excludes []string
+	// Globs from -include. If any, only matching files are sent.
+	Includes []string
+
+	// Rules of the ignore files in the folders being walked, outermost first.
+	rules []ignoreRule
+}
+
+// A line of an ignore file.
+type ignoreRule struct {
+	// Folder of the ignore file. Empty for the folder being sent.
+	base    string
+	pattern string
+	// '!pattern' brings back what an earlier rule ignored.
+	negate bool
+	// 'pattern/' only matches folders.
+	dirOnly bool
+	// A pattern with a '/' matches from base, one without matches a name at any depth.
+	anchored bool
+}
+
+func NewFileFilter(excludes, includes []string) *FileFilter {
+	return &FileFilter{Excludes: excludes, Includes: includes}
+}
+
+// Whether the file or folder is left out, by -exclude or an ignore file.
+// '.git' folders are left out too, unless an -include pattern matches them, like '-include=.git'.
+func (f *FileFilter) Excluded(relativePath string, isDir bool) bool {
+	if isDir && path.Base(relativePath) == ".git" && !f.matchesInclude(relativePath) {
+		return true
+	}
+
+	for _, pattern := range f.Excludes {
+		if MatchGlob(pattern, relativePath) {
+			return true
+		}
+	}
+
+	// The last matching rule decides, like git.
+	excluded := false
+	for _, rule := range f.rules {
+		if rule.matches(relativePath, isDir) {
+			excluded = !rule.negate
+		}
+	}
+
+	return excluded
+}
+
+// Whether the file is sent under -include. A pattern matching a folder includes everything in it.
+func (f *FileFilter) Included(relativePath string) bool {
+	if len(f.Includes) == 0 {
+		return true
+	}
+
+	for p := relativePath; p != "." && p != ""; p = path.Dir(p) {
+		if f.matchesInclude(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *FileFilter) matchesInclude(relativePath string) bool {
+	for _, pattern := range f.Includes {
+		if MatchGlob(pattern, relativePath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add the rules of the ignore files in the folder at absDir.
+// Returns how many rules there were before, to drop them again with popRules once the folder is walked.
+func (f *FileFilter) pushIgnoreFiles(absDir, relativeDir string) int {
+	before := len(f.rules)
+	for _, name := range IgnoreFileNames {
+		file, err := os.Open(filepath.Join(absDir, name))
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if rule, ok := parseIgnoreLine(scanner.Text(), relativeDir); ok {
+				f.rules = append(f.rules, rule)
+			}
+		}
+
+		_ = file.Close()
+	}
+
+	return before
+}
+
+func (f *FileFilter) popRules(before int) {
+	f.rules = f.rules[:before]
+}
+
+func parseIgnoreLine(line, base string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+
+	// '\#' and '\!' for names starting with those.
+	line = strings.TrimPrefix(line, "\\")
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	rule.anchored = strings.Contains(line, "/")
+	rule.pattern = strings.TrimPrefix(line, "/")
+	if rule.pattern == "" || !ValidGlob(rule.pattern) {
+		return ignoreRule{}, false
+	}
+
+	return rule, true
+}
+
+func (r *ignoreRule) matches(relativePath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if r.base != "" {
+		if !strings.HasPrefix(relativePath, r.base+"/") {
+			return false
+		}
+
+		relativePath = relativePath[len(r.base)+1:]
+	}
+
+	if !r.anchored {
+		matched, _ := path.Match(r.pattern, path.Base(relativePath))
+		return matched
+	}
+
+	return matchSegments(strings.Split(r.pattern, "/"), strings.Split(relativePath, "/"))
+}
@@ -0,0 +1,134 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileFilterGit(t *testing.T) {
+	tests := []struct {
+		name         string
+		includes     []string
+		relativePath string
+		isDir        bool
+		wantExcluded bool
+		wantIncluded bool
+	}{
+		{"git folder", nil, ".git", true, true, true},
+		{"nested git folder", nil, "sub/.git", true, true, true},
+		{"file named .git", nil, ".git", false, false, true},
+		{"included by name", []string{".git"}, ".git", true, false, true},
+		{"file in folder included by name", []string{".git"}, ".git/config", false, false, true},
+		{"included by glob", []string{".git/**"}, ".git", true, false, true},
+		{"file in folder included by glob", []string{".git/**"}, ".git/objects/ab/cd", false, false, true},
+		{"other include", []string{"src/**"}, ".git", true, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter := NewFileFilter(nil, test.includes)
+			if excluded := filter.Excluded(test.relativePath, test.isDir); excluded != test.wantExcluded {
+				t.Errorf("Excluded(%q) = %v, want %v", test.relativePath, excluded, test.wantExcluded)
+			}
+
+			if included := filter.Included(test.relativePath); included != test.wantIncluded {
+				t.Errorf("Included(%q) = %v, want %v", test.relativePath, included, test.wantIncluded)
+			}
+		})
+	}
+}
+
+func TestParseIgnoreLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		want   ignoreRule
+		wantOk bool
+	}{
+		{"", ignoreRule{}, false},
+		{"   ", ignoreRule{}, false},
+		{"# comment", ignoreRule{}, false},
+		{"*.log", ignoreRule{base: "sub", pattern: "*.log"}, true},
+		{"*.log  \r", ignoreRule{base: "sub", pattern: "*.log"}, true},
+		{"!keep.log", ignoreRule{base: "sub", pattern: "keep.log", negate: true}, true},
+		{"build/", ignoreRule{base: "sub", pattern: "build", dirOnly: true}, true},
+		{"/build", ignoreRule{base: "sub", pattern: "build", anchored: true}, true},
+		{"out/*.o", ignoreRule{base: "sub", pattern: "out/*.o", anchored: true}, true},
+		{"\\#notes", ignoreRule{base: "sub", pattern: "#notes"}, true},
+		{"\\!important", ignoreRule{base: "sub", pattern: "!important"}, true},
+		{"/", ignoreRule{}, false},
+		{"!", ignoreRule{}, false},
+		{"data/[", ignoreRule{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			rule, ok := parseIgnoreLine(test.line, "sub")
+			if ok != test.wantOk || (ok && rule != test.want) {
+				t.Errorf("parseIgnoreLine(%q) = %+v, %v, want %+v, %v", test.line, rule, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestFileFilterIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFile := func(relativePath, contents string) {
+		targetPath := filepath.Join(root, filepath.FromSlash(relativePath))
+		if err := os.MkdirAll(filepath.Dir(targetPath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(targetPath, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeFile(".gitignore", "*.log\n/build\ntmp/\n")
+	writeFile(".tshareignore", "!keep.log\n")
+	writeFile("sub/.gitignore", "# only in sub\n*.txt\n/out\n")
+
+	filter := NewFileFilter([]string{"*.bak"}, nil)
+	rootRules := filter.pushIgnoreFiles(root, "")
+	subRules := filter.pushIgnoreFiles(filepath.Join(root, "sub"), "sub")
+
+	tests := []struct {
+		relativePath string
+		isDir        bool
+		want         bool
+	}{
+		{"a.log", false, true},
+		{"sub/deep/a.log", false, true},
+		{"keep.log", false, false},
+		{"sub/keep.log", false, false},
+		{"build", true, true},
+		{"sub/build", true, false},
+		{"tmp", true, true},
+		{"sub/tmp", true, true},
+		{"tmp", false, false},
+		{"a.txt", false, false},
+		{"sub/a.txt", false, true},
+		{"sub/deep/a.txt", false, true},
+		{"out", true, false},
+		{"sub/out", true, true},
+		{"a.bak", false, true},
+		{"main.go", false, false},
+	}
+
+	for _, test := range tests {
+		if got := filter.Excluded(test.relativePath, test.isDir); got != test.want {
+			t.Errorf("Excluded(%q, %v) = %v, want %v", test.relativePath, test.isDir, got, test.want)
+		}
+	}
+
+	// Leaving sub drops its rules, and the root's once the walk is done.
+	filter.popRules(subRules)
+	if filter.Excluded("sub/a.txt", false) {
+		t.Error("Rules of sub still apply after it was walked.")
+	}
+
+	filter.popRules(rootRules)
+	if filter.Excluded("a.log", false) {
+		t.Error("Rules of the root still apply after it was walked.")
+	}
+}
@@ -0,0 +1,57 @@
+package shared
+
+import (
+	"path"
+	"strings"
+)
+
+// Match a '/' separated relative path against a glob.
+// Segments match as in path.Match, and a '**' segment matches any number of segments, including none.
+// A pattern without a '/' matches the last segment only, so '*.go' matches Go files in any folder.
+func MatchGlob(pattern, relativePath string) bool {
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(relativePath))
+		return matched
+	}
+
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(relativePath, "/"))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try consuming 0..n segments with the '**'.
+			for skip := 0; skip <= len(segments); skip++ {
+				if matchSegments(pattern[1:], segments[skip:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+
+		if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+			return false
+		}
+
+		pattern = pattern[1:]
+		segments = segments[1:]
+	}
+
+	return len(segments) == 0
+}
+
+// Whether the glob is well formed.
+func ValidGlob(pattern string) bool {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
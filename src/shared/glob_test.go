@@ -0,0 +1,64 @@
+package shared
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern      string
+		relativePath string
+		want         bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "src/lib/util.go", true},
+		{"*.go", "main.go.bak", false},
+		{"main.go", "src/main.go", true},
+		{"src/*.go", "src/main.go", true},
+		{"src/*.go", "src/lib/util.go", false},
+		{"src/*.go", "other/src/main.go", false},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/lib/deep/util.go", true},
+		{"src/**", "src", true},
+		{"src/**", "src/lib/util.go", true},
+		{"**/build", "build", true},
+		{"**/build", "a/b/build", true},
+		{"**/build", "a/b/build/out.o", false},
+		{"a/**/b/**/c", "a/x/b/y/z/c", true},
+		{"a/**/b/**/c", "a/c", false},
+		{"data/?.txt", "data/a.txt", true},
+		{"data/?.txt", "data/ab.txt", false},
+		{"data/[ab].txt", "data/b.txt", true},
+		{"data/[ab].txt", "data/c.txt", false},
+		{"*", ".hidden", true},
+		{"data/*", "data", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern+" "+test.relativePath, func(t *testing.T) {
+			if got := MatchGlob(test.pattern, test.relativePath); got != test.want {
+				t.Errorf("MatchGlob(%q, %q) = %v, want %v", test.pattern, test.relativePath, got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"*.go", true},
+		{"src/**/*.go", true},
+		{"data/[a-z].txt", true},
+		{"data/[", false},
+		{"data/[a-].txt", false},
+		{"src/\\", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			if got := ValidGlob(test.pattern); got != test.want {
+				t.Errorf("ValidGlob(%q) = %v, want %v", test.pattern, got, test.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,21 @@ package shared
 
 import (
 	"fmt"
+	"io"
 	"math/rand"
 )
 
+// How the progress bar is drawn, from the -pb flags.
+type ProgressBarOptions struct {
+	// single, total
+	Type   string
+	Length int
+	RGB    bool
+	// Display progress in MB or kb
+	InMB bool
+	Off  bool
+}
+
 type ProgressBar struct {
 	OngoingFileSize            int
 	OngoingFileTransferredSize int
@@ -29,27 +41,34 @@ type ProgressBar struct {
 	TrailingText string
 	Colours      []string
 	IsOff        bool
+	// Streams have no size up front. Only the transferred size is shown.
+	SizeUnknown bool
+	// Called with the transferred and total size whenever either changes, even with the bar off.
+	OnProgress func(transferred, total int)
+	// Where the bar and the messages around it are printed.
+	Output io.Writer
 }
 
-func NewProgressBar(totalFileSize int, pbType string, barLen int, rgbOn bool, trailingText string, inMB bool, isOff bool) *ProgressBar {
+func NewProgressBar(totalFileSize int, opts ProgressBarOptions, trailingText string, out io.Writer) *ProgressBar {
 	var SizeConvDiv float64 = 1000
 	var sizeUnit string = "kb"
-	if inMB {
+	if opts.InMB {
 		SizeConvDiv = 1000_000
 		sizeUnit = "MB"
 	}
 	return &ProgressBar{
 		TotalTransferSize: totalFileSize,
-		TotalTransferBlip: totalFileSize / barLen,
-		Type:              pbType,
-		BarLength:         barLen,
-		RgbOn:             rgbOn,
+		TotalTransferBlip: totalFileSize / opts.Length,
+		Type:              opts.Type,
+		BarLength:         opts.Length,
+		RgbOn:             opts.RGB,
 		TrailingText:      trailingText,
-		InMB:              inMB,
+		InMB:              opts.InMB,
 		SizeConvDiv:       SizeConvDiv,
 		SizeUnit:          sizeUnit,
 		Colours:           []string{"red", "yellow", "magenta", "green", "cyan"},
-		IsOff:             isOff,
+		IsOff:             opts.Off,
+		Output:            out,
 	}
 }
 
@@ -59,10 +78,66 @@ func (pb *ProgressBar) PrintPostDoneMessage(message string) {
 	}
 
 	if pb.Type == "single" {
-		fmt.Println(message)
+		fmt.Fprintln(pb.Output, message)
 	}
 }
 
+// Print a line without it getting overwritten by the next redraw of the bar.
+func (pb *ProgressBar) PrintAbove(message string) {
+	if pb.IsOff || pb.Type != "total" || !pb.AllTransferStarted {
+		fmt.Fprintln(pb.Output, message)
+		return
+	}
+
+	// Clear the bar, print the message and draw the bar again below it.
+	fmt.Fprintf(pb.Output, "\033[F\033[F\033[J%s\n", message)
+	pb.AllTransferStarted = false
+	pb.Show()
+}
+
+// Change the total size, for when only some of the files are transferred.
+func (pb *ProgressBar) SetTotalSize(totalFileSize int) {
+	pb.TotalTransferSize = totalFileSize
+	pb.TotalTransferBlip = totalFileSize / pb.BarLength
+	pb.report()
+}
+
+func (pb *ProgressBar) SetSizeUnknown() {
+	pb.SizeUnknown = true
+}
+
+// Filled part of the bar.
+func (pb *ProgressBar) fill(transferred, blip int) string {
+	fillSize := 0
+	if blip > 0 && !pb.SizeUnknown {
+		fillSize = transferred / blip
+	}
+
+	fill_container := ""
+	for i := 0; i < pb.BarLength; i++ {
+		if i < fillSize {
+			fill_container += "#"
+		} else {
+			fill_container += "-"
+		}
+	}
+
+	if pb.RgbOn {
+		fill_container = ColourSprintf(fill_container, RandomString(pb.Colours), false)
+	}
+
+	return fill_container
+}
+
+// 'transferred/total unit'
+func (pb *ProgressBar) sizeText(transferred, total int) string {
+	if pb.SizeUnknown {
+		return fmt.Sprintf("%.2f %s", float64(transferred)/pb.SizeConvDiv, pb.SizeUnit)
+	}
+
+	return fmt.Sprintf("%.2f/%.2f %s", float64(transferred)/pb.SizeConvDiv, float64(total)/pb.SizeConvDiv, pb.SizeUnit)
+}
+
 // Reset individual values for the new file.
 func (pb *ProgressBar) UpdateOngoingForNewFile(filesize int) {
 	pb.TransferStarted = false
@@ -76,11 +151,24 @@ func (pb *ProgressBar) UpdateOngoingForNewFile(filesize int) {
 	}
 }
 
+// Undo the progress of the ongoing file, for when it is going to be sent again.
+func (pb *ProgressBar) RewindOngoing() {
+	pb.TotalTransferredSize -= pb.OngoingFileTransferredSize
+	pb.OngoingFileTransferredSize = 0
+	pb.report()
+}
+
 // Update with the size of the recent chunk transferred
 func (pb *ProgressBar) UpdateTransferredSize(chunkSize int) {
 	pb.OngoingFileTransferredSize += chunkSize
 	pb.TotalTransferredSize += chunkSize
+	pb.report()
+}
 
+func (pb *ProgressBar) report() {
+	if pb.OnProgress != nil {
+		pb.OnProgress(pb.TotalTransferredSize, pb.TotalTransferSize)
+	}
 }
 
 func (pb *ProgressBar) Show() {
@@ -98,52 +186,28 @@ func (pb *ProgressBar) Show() {
 
 // Show for invididual
 func (pb *ProgressBar) ShowIndividualProgress() {
-	fillSize := pb.OngoingFileTransferredSize / pb.OngoingFileBlip
-	fill_container := ""
-
-	for i := 0; i < pb.BarLength; i++ {
-		if i < fillSize {
-			fill_container += "#"
-		} else {
-			fill_container += "-"
-		}
-	}
-
-	if pb.RgbOn {
-		fill_container = ColourSprintf(fill_container, RandomString(pb.Colours), false)
-	}
+	fill_container := pb.fill(pb.OngoingFileTransferredSize, pb.OngoingFileBlip)
+	size := pb.sizeText(pb.OngoingFileTransferredSize, pb.OngoingFileSize)
 
 	if !pb.TransferStarted {
-		fmt.Printf("\n%s\n%.2f/%.2f %s %s\n", fill_container, float64(pb.OngoingFileTransferredSize)/pb.SizeConvDiv, float64(pb.OngoingFileSize)/pb.SizeConvDiv, pb.SizeUnit, pb.TrailingText)
+		fmt.Fprintf(pb.Output, "\n%s\n%s %s\n", fill_container, size, pb.TrailingText)
 		pb.TransferStarted = true
 
 	} else {
-		fmt.Printf("\033[F\033[F%s\n%.2f/%.2f %s %s\n", fill_container, float64(pb.OngoingFileTransferredSize)/pb.SizeConvDiv, float64(pb.OngoingFileSize)/pb.SizeConvDiv, pb.SizeUnit, pb.TrailingText)
+		fmt.Fprintf(pb.Output, "\033[F\033[F%s\n%s %s\n", fill_container, size, pb.TrailingText)
 	}
 }
 
 func (pb *ProgressBar) ShowTotalProgress() {
-	fillSize := pb.TotalTransferredSize / pb.TotalTransferBlip
-	fill_container := ""
-
-	for i := 0; i < pb.BarLength; i++ {
-		if i < fillSize {
-			fill_container += "#"
-		} else {
-			fill_container += "-"
-		}
-	}
-
-	if pb.RgbOn {
-		fill_container = ColourSprintf(fill_container, RandomString(pb.Colours), false)
-	}
+	fill_container := pb.fill(pb.TotalTransferredSize, pb.TotalTransferBlip)
+	size := pb.sizeText(pb.TotalTransferredSize, pb.TotalTransferSize)
 
 	if !pb.AllTransferStarted {
-		fmt.Printf("\n%s\n%.2f/%.2f %s %s\n", fill_container, float64(pb.TotalTransferredSize)/pb.SizeConvDiv, float64(pb.TotalTransferSize)/pb.SizeConvDiv, pb.SizeUnit, pb.TrailingText)
+		fmt.Fprintf(pb.Output, "\n%s\n%s %s\n", fill_container, size, pb.TrailingText)
 		pb.AllTransferStarted = true
 
 	} else {
-		fmt.Printf("\033[F\033[F%s\n%.2f/%.2f %s %s\n", fill_container, float64(pb.TotalTransferredSize)/pb.SizeConvDiv, float64(pb.TotalTransferSize)/pb.SizeConvDiv, pb.SizeUnit, pb.TrailingText)
+		fmt.Fprintf(pb.Output, "\033[F\033[F%s\n%s %s\n", fill_container, size, pb.TrailingText)
 
 	}
 }
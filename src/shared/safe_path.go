@@ -0,0 +1,160 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Names Windows reserves for devices, with or without an extension.
+var windowsReservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// Check a relative path received from the sender before anything is written with it.
+// Paths are '/' separated and must stay inside the receive folder on every OS, so this rejects
+// absolute paths, '..' and '.' segments, backslashes, drive letters and other colons,
+// Windows reserved names and segments Windows would silently trim.
+func ValidateRelativePath(relativePath string) error {
+	if relativePath == "" {
+		return fmt.Errorf("E:Unsafe path %q. Path is empty.", relativePath)
+	}
+
+	if strings.ContainsRune(relativePath, 0) {
+		return fmt.Errorf("E:Unsafe path %q. Path contains a NUL byte.", relativePath)
+	}
+
+	// A separator on Windows. '..\..\x' would escape there.
+	if strings.Contains(relativePath, "\\") {
+		return fmt.Errorf("E:Unsafe path %q. Path contains a backslash.", relativePath)
+	}
+
+	// Drive letters 'C:x' and alternate data streams 'x:stream'.
+	if strings.Contains(relativePath, ":") {
+		return fmt.Errorf("E:Unsafe path %q. Path contains a colon.", relativePath)
+	}
+
+	if strings.HasPrefix(relativePath, "/") {
+		return fmt.Errorf("E:Unsafe path %q. Path is absolute.", relativePath)
+	}
+
+	for _, segment := range strings.Split(relativePath, "/") {
+		switch segment {
+		case "":
+			return fmt.Errorf("E:Unsafe path %q. Path has an empty segment.", relativePath)
+		case ".", "..":
+			return fmt.Errorf("E:Unsafe path %q. Path has a '%s' segment.", relativePath, segment)
+		}
+
+		// Windows drops trailing dots and spaces, '.. ' would become '..'.
+		if strings.HasSuffix(segment, ".") || strings.HasSuffix(segment, " ") {
+			return fmt.Errorf("E:Unsafe path %q. Segment %q ends with a dot or space.", relativePath, segment)
+		}
+
+		base, _, _ := strings.Cut(segment, ".")
+		for _, reserved := range windowsReservedNames {
+			if strings.EqualFold(strings.TrimRight(base, " "), reserved) {
+				return fmt.Errorf("E:Unsafe path %q. %q is a reserved name on Windows.", relativePath, segment)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check the target of a symlink the sender wants created at relativePath.
+// The target must be relative and resolve inside the receive folder, from the folder the link is in.
+// '..' is only allowed in front, where it climbs the folders the link is in. Further on it could climb
+// out of wherever another link points, like 's/../..' with 's -> .', whichever of them is created first.
+func ValidateLinkTarget(relativePath, linkTarget string) error {
+	if linkTarget == "" || strings.ContainsRune(linkTarget, 0) {
+		return fmt.Errorf("E:Unsafe link %q. Invalid target %q.", relativePath, linkTarget)
+	}
+
+	if strings.Contains(linkTarget, "\\") || strings.Contains(linkTarget, ":") || strings.HasPrefix(linkTarget, "/") {
+		return fmt.Errorf("E:Unsafe link %q. Target %q is not a relative '/' separated path.", relativePath, linkTarget)
+	}
+
+	segments := strings.Split(linkTarget, "/")
+	climbs := 0
+	for climbs < len(segments) && segments[climbs] == ".." {
+		climbs++
+	}
+
+	if slices.Contains(segments[climbs:], "..") {
+		return fmt.Errorf("E:Unsafe link %q. Target %q has a '..' segment after the start.", relativePath, linkTarget)
+	}
+
+	resolved := path.Join(path.Dir(relativePath), linkTarget)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("E:Unsafe link %q. Target %q points outside the receive folder.", relativePath, linkTarget)
+	}
+
+	return nil
+}
+
+// Check that targetPath, following any symlinks, is inside root. Paths that do not resolve, like a link
+// to a file not received yet, pass.
+func ResolvesInside(root, targetPath string) error {
+	resolved, err := filepath.EvalSymlinks(targetPath)
+	if err != nil {
+		return nil
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("E:Resolving %s. %s", root, err.Error())
+	}
+
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return fmt.Errorf("E:Resolving %s. %s", targetPath, err.Error())
+	}
+
+	resolvedRoot, err = filepath.Abs(resolvedRoot)
+	if err != nil {
+		return fmt.Errorf("E:Resolving %s. %s", root, err.Error())
+	}
+
+	relative, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("E:Unsafe path %s. It resolves to %s, outside of %s.", targetPath, resolved, root)
+	}
+
+	return nil
+}
+
+// Join a relative path from the sender onto root, refusing anything that would land outside of it.
+// Besides ValidateRelativePath, no existing part of the path below root may be a symlink,
+// since writing through it could escape root. root itself may be a symlink.
+func SafeJoin(root, relativePath string) (string, error) {
+	if err := ValidateRelativePath(relativePath); err != nil {
+		return "", err
+	}
+
+	target := root
+	for _, segment := range strings.Split(relativePath, "/") {
+		target = filepath.Join(target, segment)
+
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			// Nothing below exists yet, so it is created inside root.
+			break
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("E:Checking path %s. %s", target, err.Error())
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("E:Unsafe path %q. %s is a symlink.", relativePath, target)
+		}
+	}
+
+	return filepath.Join(root, filepath.FromSlash(relativePath)), nil
+}
@@ -0,0 +1,187 @@
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateRelativePath(t *testing.T) {
+	tests := []struct {
+		name         string
+		relativePath string
+		wantErr      bool
+	}{
+		{"file", "a.txt", false},
+		{"nested", "data/src/main.go", false},
+		{"dot inside a name", "data/.config/a.tar.gz", false},
+		{"empty", "", true},
+		{"nul byte", "a\x00.txt", true},
+		{"absolute", "/etc/passwd", true},
+		{"parent", "../a.txt", true},
+		{"parent inside", "data/../../a.txt", true},
+		{"dot segment", "data/./a.txt", true},
+		{"empty segment", "data//a.txt", true},
+		{"trailing slash", "data/", true},
+		{"backslash", "..\\..\\a.txt", true},
+		{"drive letter", "C:a.txt", true},
+		{"drive letter absolute", "C:/Windows/a.txt", true},
+		{"alternate data stream", "a.txt:stream", true},
+		{"reserved name", "CON", true},
+		{"reserved name with extension", "data/nul.txt", true},
+		{"reserved name lower case", "data/com1", true},
+		{"reserved name as prefix", "console.txt", false},
+		{"trailing dot", "data/a.", true},
+		{"trailing space", "data/a ", true},
+		{"parent with trailing space", ".. /a.txt", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateRelativePath(test.relativePath)
+			if (err != nil) != test.wantErr {
+				t.Errorf("ValidateRelativePath(%q) = %v, want error %v", test.relativePath, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "data"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skip("Symlinks not supported.", err)
+	}
+
+	if err := os.Symlink(filepath.Join(outside, "a.txt"), filepath.Join(root, "data", "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		relativePath string
+		want         string
+		wantErr      bool
+	}{
+		{"new file", "a.txt", filepath.Join(root, "a.txt"), false},
+		{"in existing folder", "data/a.txt", filepath.Join(root, "data", "a.txt"), false},
+		{"in new folders", "new/deep/a.txt", filepath.Join(root, "new", "deep", "a.txt"), false},
+		{"symlinked parent", "escape/a.txt", "", true},
+		{"symlinked parent deeper", "escape/new/a.txt", "", true},
+		{"symlink at target", "data/link.txt", "", true},
+		{"parent", "../a.txt", "", true},
+		{"absolute", "/etc/passwd", "", true},
+		{"backslash", "data\\..\\..\\a.txt", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SafeJoin(root, test.relativePath)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("SafeJoin(%q) = %v, want error %v", test.relativePath, err, test.wantErr)
+			}
+
+			if got != test.want {
+				t.Errorf("SafeJoin(%q) = %q, want %q", test.relativePath, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSafeJoinSymlinkedRoot(t *testing.T) {
+	realRoot := t.TempDir()
+	root := filepath.Join(t.TempDir(), "root")
+	if err := os.Symlink(realRoot, root); err != nil {
+		t.Skip("Symlinks not supported.", err)
+	}
+
+	if _, err := SafeJoin(root, "data/a.txt"); err != nil {
+		t.Errorf("SafeJoin through a symlinked root = %v, want no error", err)
+	}
+}
+
+func TestValidateLinkTarget(t *testing.T) {
+	tests := []struct {
+		name         string
+		relativePath string
+		linkTarget   string
+		wantErr      bool
+	}{
+		{"sibling", "data/link", "a.txt", false},
+		{"own folder", "data/src/s", ".", false},
+		{"down", "data/link", "src/main.go", false},
+		{"up then down", "data/src/up", "../lib", false},
+		{"up to root", "data/src/up", "../..", false},
+		{"up past root", "data/up", "../..", true},
+		{"up past root from root", "link", "..", true},
+		{"up past root then down", "data/up", "../../data/a.txt", true},
+		{"chain through a link", "data/src/t", "s/../..", true},
+		{"climb after descending", "data/link", "src/../a.txt", true},
+		{"absolute", "data/link", "/etc/passwd", true},
+		{"backslash", "data/link", "..\\..\\a.txt", true},
+		{"drive letter", "data/link", "C:/Windows", true},
+		{"empty", "data/link", "", true},
+		{"nul byte", "data/link", "a\x00", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateLinkTarget(test.relativePath, test.linkTarget)
+			if (err != nil) != test.wantErr {
+				t.Errorf("ValidateLinkTarget(%q, %q) = %v, want error %v", test.relativePath, test.linkTarget, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolvesInside(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "src"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	// The link chain ValidateLinkTarget refuses, created by hand.
+	if err := os.Symlink(".", filepath.Join(root, "src", "s")); err != nil {
+		t.Skip("Symlinks not supported.", err)
+	}
+
+	links := map[string]string{
+		"src/t":        filepath.FromSlash("s/../.."),
+		"src/up":       "..",
+		"src/dangling": "missing.txt",
+		"out":          outside,
+	}
+
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		link    string
+		wantErr bool
+	}{
+		{"src/s", false},
+		{"src/up", false},
+		{"src/dangling", false},
+		{"src/t", true},
+		{"out", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.link, func(t *testing.T) {
+			err := ResolvesInside(root, filepath.Join(root, filepath.FromSlash(test.link)))
+			if (err != nil) != test.wantErr {
+				t.Errorf("ResolvesInside(%q) = %v, want error %v", test.link, err, test.wantErr)
+			}
+		})
+	}
+}
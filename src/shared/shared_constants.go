@@ -1,5 +1,11 @@
 package shared
 
+import (
+	"io"
+	"math"
+	"os"
+)
+
 const (
 	// Register a sender
 	InitialTypeRegisterSender = uint8(0x01)
@@ -33,8 +39,8 @@ const (
 	// Server responds with transfer metadata of the transfer to receiver
 	InitialTypeReceiverMD = uint8(0x21)
 
-	// Receiver requests next pkt from server which inturn requests from sender
-	InitialTypeRequestNextPacket = uint8(0x22)
+	// Receiver grants the sender credit to stream more packets of the active file.
+	InitialTypeGrantCredit = uint8(0x22)
 
 	// A single file has finished transferring
 	InitialTypeSingleFileTransferFinish = uint8(0x23)
@@ -51,7 +57,7 @@ const (
 	// Server notifies the client that the connection is going to be closed.
 	InitialTypeCloseConnNotify = uint8(0x27)
 
-	// Server responds back to sender with the transfer code
+	// Server responds back to sender with the nameplate of the transfer code
 	InitialTypeTransferCode = uint8(0x28)
 
 	// Receiver aborts the transfer
@@ -60,30 +66,100 @@ const (
 	// Receiver invokes a transfer of file with given idx from the server.
 	InitialTypeStartTransferWithId = uint8(0x30)
 
+	// SPAKE2 element keyed on the transfer code. Forwarded as is between sender and receiver.
+	InitialTypePakeMessage = uint8(0x31)
+
+	// Proof that the sender/receiver derived the same key. Sent before any sealed payload.
+	InitialTypePakeConfirm = uint8(0x32)
+
+	// Receiver resumes a partially received file with given idx from a byte offset.
+	InitialTypeStartTransferWithIdAtOffset = uint8(0x33)
+
+	// Server notifies the sender that the receiver dropped. The session is kept open for it to reconnect.
+	InitialTypeReceiverDisconnected = uint8(0x34)
+
+	// Part of the sealed file manifest, uploaded by the sender before the transfer code is issued.
+	InitialTypeManifestChunk = uint8(0x35)
+
+	// Sender finished uploading the manifest.
+	InitialTypeManifestEnd = uint8(0x36)
+
+	// Server stored the manifest. Sent to the sender right before the transfer code.
+	InitialTypeManifestAck = uint8(0x37)
+
+	// Receiver does not want the file with given id. The sender counts it as sent.
+	InitialTypeSkipFile = uint8(0x38)
+
+	// Receiver only wants the files with the given ids. The sender counts the others as sent.
+	InitialTypeSelectFiles = uint8(0x39)
+
+	// Receiver picks the codec, of the ones the sender offered, that transfer packets may be compressed with.
+	InitialTypeUseCodec = uint8(0x3A)
+
+	// Receiver asks for the files with the given ids as one tar stream, in archive mode.
+	InitialTypeStartArchive = uint8(0x3B)
+
 	// current version
-	Version = byte(1)
+	Version = byte(2)
+)
+
+// Type of a manifest entry.
+const (
+	EntryTypeFile = uint8(0)
+	// An empty folder. Folders with files in them are created along with the files.
+	EntryTypeDir = uint8(1)
+	// A symlink to LinkTarget, sent with -symlinks=preserve.
+	EntryTypeSymlink = uint8(2)
+)
+
+// What a transfer carries, set in the metadata sent to the receiver.
+const (
+	ContentKindFiles = uint8(0)
+	// A text snippet, printed by the receiver. Nothing is written to disk.
+	ContentKindText = uint8(1)
 )
 
+// Text snippets ride along in the metadata, anything longer is sent as a file.
+const MaxTextSize = 64 * 1024
+
+// Bytes of a file per transfer packet, unless set with -chunk.
+const DefaultChunkSize = 1000 * 1024
+
+// File ids are uint32 and start at 1.
+const MaxFileCount = math.MaxUint32
+
+// Defaults of the CLI. A transfer gets its own endpoint and output in its options.
 var (
 	Endpoint = "wss://multi-serve.onrender.com/api/share"
+	// Where messages and the progress bar are printed.
+	Output io.Writer = os.Stdout
 )
 
-type Packet struct {
-	Version    byte
-	UniqueCode byte
-	Timestamp  int64
-	Data       []byte
-}
-
 type FileInfo struct {
 	Name string
 	// Relative to the target folder.
 	RelativePath string
-	// Abs path of the file in the system.
-	AbsPath string
+	// Abs path of the file in the system. Never leaves the sender.
+	AbsPath string `json:"-"`
 	Size    uint64
 
-	// Unique id for each file. Used to invoke transfer of a certain file from the sender.
-	// Only 254 files can be shared at once
-	Id uint8
+	// Unique id for each file, counting up from 1 in order.
+	// Used to invoke transfer of a certain file from the sender.
+	Id uint32
+
+	// Hex encoded sha256 of the file contents. Checked by the receiver once the file is written.
+	// Empty for streams, whose hash is sent at the end instead.
+	Hash string
+
+	// Read from stdin until EOF. Size is 0 and Hash is empty.
+	SizeUnknown bool
+
+	// EntryTypeFile, EntryTypeDir or EntryTypeSymlink.
+	Type uint8
+	// '/' separated target of a symlink, as read from the link.
+	LinkTarget string `json:",omitempty"`
+	// Permission bits. 0 if unknown.
+	Mode uint32
+	// Modification time in unix nanoseconds. 0 if unknown.
+	ModTime int64
 }
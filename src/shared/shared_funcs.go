@@ -2,15 +2,17 @@ package shared
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/gorilla/websocket"
 )
 
 func CreateBinaryPacket(parts ...any) ([]byte, error) {
@@ -24,97 +26,275 @@ func CreateBinaryPacket(parts ...any) ([]byte, error) {
 	return responseBfr.Bytes(), nil
 }
 
-// Returns the connected ws
-func InitConnection(endpoint string) (*websocket.Conn, error) {
-	conn, _, err := websocket.DefaultDialer.Dial(endpoint, nil)
-	if err != nil {
-		log.Println("E:Connecting ws server.", err.Error())
-		return nil, err
+// Read the next word from stdin like fmt.Scan, giving up once ctx is cancelled.
+// The read is left behind then, the process is about to exit.
+func ScanWord(ctx context.Context) (string, error) {
+	type result struct {
+		word string
+		err  error
 	}
 
-	return conn, nil
-}
+	read := make(chan result, 1)
+	go func() {
+		var word string
+		_, err := fmt.Scan(&word)
+		read <- result{word, err}
+	}()
 
-func RequestCloseConn(conn *websocket.Conn) {
-	packet, err := CreateBinaryPacket(Version, InitialTypeCloseConn)
-	if err != nil {
-		log.Println("E:Creating closure package. Quitting.")
-		_ = conn.Close()
-	}
-
-	if err := conn.WriteMessage(websocket.BinaryMessage, packet); err != nil {
-		log.Println("E:Writing closure message to server. Quitting.")
-		_ = conn.Close()
+	select {
+	case res := <-read:
+		return res.word, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
 	}
 }
 
+// What to do with symlinks in a folder being sent. Set with -symlinks.
+const (
+	SymlinksSkip = "skip"
+	// Send what the link points to. Links to folders are walked, unless they loop back.
+	SymlinksFollow = "follow"
+	// Send the link itself, recreated by the receiver.
+	SymlinksPreserve = "preserve"
+)
+
+var SymlinkPolicies = []string{SymlinksSkip, SymlinksFollow, SymlinksPreserve}
+
 // Can take in both a single file path or a path to some dir
 // If dir is provided, all the files (even under other subdirs) are returned
-func GetAllFileInfo(targetPath string) (*[]FileInfo, error) {
-	var allFileInfo []FileInfo
+// Symlinks inside the dir are handled according to symlinks. The target path itself is always followed.
+// Files in the dir that filter leaves out never enter the manifest. Skipped entries are reported to out.
+func GetAllFileInfo(targetPath string, symlinks string, filter *FileFilter, out io.Writer) (*[]FileInfo, error) {
 	targetPathInfo, err := os.Stat(targetPath)
 	if err != nil {
 		return nil, fmt.Errorf("E:Getting provided path info. %s", err.Error())
 	}
 
-	var id_count uint8 = 1
+	absTargetPath, err := filepath.Abs(targetPath)
+	if err != nil {
+		return nil, fmt.Errorf("E:Could not get abs filepath. %s", err.Error())
+	}
+
+	walker := &fileWalker{symlinks: symlinks, filter: filter, out: out, ancestors: make(map[string]bool)}
 
 	// Return single file with its name and size
 	if !targetPathInfo.IsDir() {
-		allFileInfo = append(allFileInfo, FileInfo{
-			Name:         targetPathInfo.Name(),
-			Size:         uint64(targetPathInfo.Size()),
-			RelativePath: targetPathInfo.Name(),
-			AbsPath:      targetPath,
-			Id:           id_count,
-		})
+		if err := walker.addFile(absTargetPath, targetPathInfo.Name(), targetPathInfo); err != nil {
+			return nil, err
+		}
+
+		return &walker.files, nil
+	}
+
+	// Paths are relative to the folder containing the target, so they start with its name.
+	walker.rootName = filepath.Base(absTargetPath)
+	if err := walker.walkDir(absTargetPath, walker.rootName, targetPathInfo); err != nil {
+		return nil, err
+	}
 
-		return &allFileInfo, nil
+	return &walker.files, nil
+}
+
+type fileWalker struct {
+	files    []FileInfo
+	symlinks string
+	filter   *FileFilter
+	out      io.Writer
+	// Name of the folder being sent, the first segment of every relative path.
+	rootName string
+	// Real paths of the folders being walked, down from the target. A followed link to one of them is a cycle.
+	ancestors map[string]bool
+}
+
+func (w *fileWalker) walkDir(absPath, relativePath string, info fs.FileInfo) error {
+	realPath, err := filepath.EvalSymlinks(absPath)
+	if err != nil {
+		return fmt.Errorf("E:Resolving %s. %s", absPath, err.Error())
 	}
 
-	folderName := filepath.Base(targetPath)
+	if w.ancestors[realPath] {
+		fmt.Fprintf(w.out, "Skipping %s. The link loops back to %s.\n", relativePath, realPath)
+		return nil
+	}
+
+	w.ancestors[realPath] = true
+	defer delete(w.ancestors, realPath)
+
+	dirEntries, err := os.ReadDir(absPath)
+	if err != nil {
+		return fmt.Errorf("E:Reading dir. %s", err.Error())
+	}
 
-	if err := filepath.Walk(targetPath, func(path string, info fs.FileInfo, err error) error {
+	// Only empty folders are sent, the rest are created along with their files.
+	if len(dirEntries) == 0 {
+		if !w.filter.Included(w.filterPath(relativePath)) {
+			return nil
+		}
+
+		return w.add(FileInfo{
+			Name:         info.Name(),
+			AbsPath:      absPath,
+			RelativePath: relativePath,
+			Type:         EntryTypeDir,
+			Mode:         uint32(info.Mode().Perm()),
+			ModTime:      info.ModTime().UnixNano(),
+		})
+	}
+
+	defer w.filter.popRules(w.filter.pushIgnoreFiles(absPath, w.filterPath(relativePath)))
+
+	for _, dirEntry := range dirEntries {
+		entryAbsPath := filepath.Join(absPath, dirEntry.Name())
+		entryRelativePath := relativePath + "/" + dirEntry.Name()
+
+		entryInfo, err := os.Lstat(entryAbsPath)
 		if err != nil {
-			return fmt.Errorf("E:Walking provided dir path. %s", err.Error())
+			return fmt.Errorf("E:Getting file info. %s", err.Error())
 		}
 
-		// Making the paths of all the files relative to the target folder instead of caller.
-		// Path parts of the file. Relative to caller not the target folder.
-		path_parts := strings.Split(filepath.ToSlash(path), "/")
-		splitIdx := 0
-		for i := 0; i < len(path_parts); i++ {
-			if path_parts[i] == folderName {
-				splitIdx = i
-				break
+		// Links to folders are matched as folders, once followed.
+		if w.filter.Excluded(w.filterPath(entryRelativePath), entryInfo.IsDir()) {
+			continue
+		}
+
+		if entryInfo.Mode()&os.ModeSymlink != 0 {
+			switch w.symlinks {
+			case SymlinksSkip:
+				continue
+
+			case SymlinksPreserve:
+				if !w.filter.Included(w.filterPath(entryRelativePath)) {
+					continue
+				}
+
+				if err := w.addSymlink(entryAbsPath, entryRelativePath, entryInfo); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			entryInfo, err = os.Stat(entryAbsPath)
+			if err != nil {
+				fmt.Fprintf(w.out, "Skipping %s. Broken link. %s\n", entryRelativePath, err.Error())
+				continue
+			}
+
+			if entryInfo.IsDir() && w.filter.Excluded(w.filterPath(entryRelativePath), true) {
+				continue
 			}
 		}
 
-		absFilePath, err := filepath.Abs(path)
+		switch {
+		case entryInfo.IsDir():
+			err = w.walkDir(entryAbsPath, entryRelativePath, entryInfo)
+		case w.filter.Included(w.filterPath(entryRelativePath)):
+			err = w.addFile(entryAbsPath, entryRelativePath, entryInfo)
+		}
+
 		if err != nil {
-			return fmt.Errorf("E:Could not get abs filepath. %s", err.Error())
+			return err
 		}
+	}
 
-		pathRelativeToTargetFolder := strings.Join(path_parts[splitIdx:], "/")
+	return nil
+}
 
-		if !info.IsDir() {
-			allFileInfo = append(allFileInfo, FileInfo{
-				Name:         info.Name(),
-				Size:         uint64(info.Size()),
-				AbsPath:      absFilePath,
-				RelativePath: pathRelativeToTargetFolder,
-				Id:           id_count,
-			})
+// Path matched by the filter, relative to the folder being sent. Empty for the folder itself.
+func (w *fileWalker) filterPath(relativePath string) string {
+	if relativePath == w.rootName {
+		return ""
+	}
 
-			id_count += 1
-		}
+	return strings.TrimPrefix(relativePath, w.rootName+"/")
+}
 
+func (w *fileWalker) addFile(absPath, relativePath string, info fs.FileInfo) error {
+	// Sockets, devices and pipes have no contents to send.
+	if !info.Mode().IsRegular() {
+		fmt.Fprintf(w.out, "Skipping %s. Not a regular file.\n", relativePath)
 		return nil
-	}); err != nil {
-		return nil, err
 	}
 
-	return &allFileInfo, nil
+	fileHash, err := HashFile(absPath)
+	if err != nil {
+		return err
+	}
+
+	return w.add(FileInfo{
+		Name:         info.Name(),
+		Size:         uint64(info.Size()),
+		AbsPath:      absPath,
+		RelativePath: relativePath,
+		Hash:         fileHash,
+		Mode:         uint32(info.Mode().Perm()),
+		ModTime:      info.ModTime().UnixNano(),
+	})
+}
+
+func (w *fileWalker) addSymlink(absPath, relativePath string, info fs.FileInfo) error {
+	linkTarget, err := os.Readlink(absPath)
+	if err != nil {
+		return fmt.Errorf("E:Reading link. %s", err.Error())
+	}
+
+	return w.add(FileInfo{
+		Name:         info.Name(),
+		AbsPath:      absPath,
+		RelativePath: relativePath,
+		Type:         EntryTypeSymlink,
+		LinkTarget:   filepath.ToSlash(linkTarget),
+	})
+}
+
+// Append the entry with the next id.
+func (w *fileWalker) add(entry FileInfo) error {
+	if uint64(len(w.files)) >= MaxFileCount-1 {
+		return fmt.Errorf("E:Too many files. At most %d can be sent at once.", MaxFileCount-1)
+	}
+
+	entry.Id = uint32(len(w.files) + 1)
+	w.files = append(w.files, entry)
+	return nil
+}
+
+// Info for streaming stdin, sent as a single file of unknown size.
+func GetStdinFileInfo() *[]FileInfo {
+	return &[]FileInfo{{
+		Name:         "stdin",
+		RelativePath: "stdin",
+		Id:           1,
+		SizeUnknown:  true,
+	}}
+}
+
+// Size shown next to an entry in the file list, '[1.00MB]' or '[dir]'.
+func EntrySizeText(file *FileInfo) string {
+	switch file.Type {
+	case EntryTypeDir:
+		return "[dir]"
+	case EntryTypeSymlink:
+		return "[link]"
+	}
+
+	return fmt.Sprintf("[%.2fMB]", float64(file.Size)/float64(1000_000))
+}
+
+// Hex encoded sha256 of the file at path.
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("E:Opening file for hashing. %s", err.Error())
+	}
+
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("E:Hashing file. %s", err.Error())
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 // Get coloured string
@@ -154,5 +334,9 @@ func ColourLogPrint(colour string, endL bool, message ...string) {
 }
 
 func ColourPrint(message string, colour string) {
-	fmt.Println(ColourSprintf(message, colour, false))
+	ColourFprint(Output, message, colour)
+}
+
+func ColourFprint(w io.Writer, message string, colour string) {
+	fmt.Fprintln(w, ColourSprintf(message, colour, false))
 }
@@ -0,0 +1,122 @@
+package shared
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Words for the secret part of transfer codes.
+// Sorted and none is a prefix of another, so any unambiguous prefix the receiver types can be completed.
+var CodeWords = []string{
+	"acorn", "adrift", "almond", "amber", "anchor", "anvil", "apricot", "arcade",
+	"archer", "arctic", "armada", "aspen", "atlas", "autumn", "badger", "bagpipe",
+	"bamboo", "banjo", "barley", "basalt", "beacon", "beetle", "bellows", "biscuit",
+	"blizzard", "blossom", "bobcat", "bonfire", "boulder", "bramble", "brisket", "bronze",
+	"buckle", "buffalo", "bugle", "burrow", "butler", "cactus", "caldera", "camel",
+	"candle", "canyon", "caravan", "cargo", "cashew", "castle", "catfish", "cavern",
+	"cedar", "cello", "chariot", "cheetah", "chimney", "citadel", "clockwork", "clover",
+	"cobalt", "cobra", "comet", "compass", "condor", "coral", "cornet", "cosmos",
+	"cottage", "coyote", "cricket", "crossover", "crystal", "cupboard", "cyclone", "dagger",
+	"dahlia", "dolphin", "domino", "donkey", "dragon", "drizzle", "drumbeat", "dungeon",
+	"eclipse", "elbow", "elephant", "ember", "emerald", "engine", "falcon", "fennel",
+	"ferret", "fiddle", "firefly", "fjord", "flannel", "fountain", "foxglove", "fresco",
+	"frigate", "gadget", "galaxy", "gargoyle", "garnet", "gazelle", "geyser", "ginger",
+	"giraffe", "glacier", "goblet", "gondola", "gorilla", "granite", "griffin", "guitar",
+	"gumdrop", "hamster", "harbor", "harpoon", "harvest", "hedgehog", "helmet", "hermit",
+	"heron", "hickory", "hornet", "iceberg", "igloo", "iguana", "indigo", "inkwell",
+	"island", "ivory", "jackal", "jaguar", "jasmine", "jigsaw", "journal", "jubilee",
+	"juniper", "kayak", "kelp", "kettle", "kiwi", "koala", "lagoon", "lantern",
+	"lava", "lemur", "lilac", "lobster", "locket", "lotus", "lumber", "lynx",
+	"magnet", "mango", "maple", "marble", "meadow", "meteor", "mimosa", "mosaic",
+	"mustang", "nebula", "nectar", "nickel", "nomad", "nutmeg", "oasis", "octopus",
+	"olive", "onyx", "opal", "orbit", "orchid", "otter", "oyster", "paddle",
+	"pagoda", "panther", "papaya", "parrot", "pebble", "pelican", "pepper", "pewter",
+	"pickle", "pigeon", "pinecone", "piston", "plaza", "pocket", "pollen", "pony",
+	"popcorn", "possum", "puffin", "pumpkin", "quartz", "quasar", "quill", "quiver",
+	"rabbit", "raccoon", "radish", "raven", "ribbon", "riddle", "rocket", "saddle",
+	"saffron", "salmon", "sapphire", "satchel", "scarab", "sherbet", "silver", "sketch",
+	"sparrow", "spindle", "squid", "stallion", "sundial", "tadpole", "teapot", "thistle",
+	"thunder", "tiger", "timber", "toucan", "trellis", "trombone", "tulip", "tundra",
+	"turnip", "turtle", "umbrella", "unicorn", "urchin", "valley", "vanilla", "velvet",
+	"violin", "volcano", "vortex", "wagon", "walnut", "walrus", "warbler", "whistle",
+	"willow", "wizard", "wombat", "yodel", "yogurt", "zebra", "zeppelin", "zinnia",
+}
+
+const (
+	DefaultCodeWordCount = 2
+	MaxCodeWordCount     = 8
+)
+
+// Pick count random words for the secret part of a transfer code.
+// Each word adds 8 bits. A wrong guess aborts the transfer, as does leaving before the guess was confirmed,
+// so an attacker gets a single try per code.
+func GenerateCodeWords(count int) ([]string, error) {
+	words := make([]string, count)
+	for i := range words {
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(CodeWords))))
+		if err != nil {
+			return nil, fmt.Errorf("E:Generating code words. %s", err.Error())
+		}
+
+		words[i] = CodeWords[idx.Int64()]
+	}
+
+	return words, nil
+}
+
+// Full transfer code, like 7-crossover-clockwork.
+// The nameplate is issued by the server for pairing, the words never leave the sender and receiver.
+func FormatCode(nameplate uint16, words []string) string {
+	return strconv.Itoa(int(nameplate)) + "-" + strings.Join(words, "-")
+}
+
+// All code words starting with prefix.
+func CompleteCodeWord(prefix string) []string {
+	start := sort.SearchStrings(CodeWords, prefix)
+	var matches []string
+	for i := start; i < len(CodeWords) && strings.HasPrefix(CodeWords[i], prefix); i++ {
+		matches = append(matches, CodeWords[i])
+	}
+
+	return matches
+}
+
+// Parse a transfer code typed by the receiver.
+// Words are case insensitive and can be shortened to any unambiguous prefix.
+// Returns the nameplate to pair on and the normalized full code.
+func ParseCode(input string) (uint16, string, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(input)), "-")
+	if len(parts) < 2 {
+		return 0, "", fmt.Errorf("Invalid code. Expected something like 7-crossover-clockwork.")
+	}
+
+	nameplate, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || nameplate == 0 {
+		return 0, "", fmt.Errorf("Invalid code. %q must be the number before the first '-'.", parts[0])
+	}
+
+	if len(parts)-1 > MaxCodeWordCount {
+		return 0, "", fmt.Errorf("Invalid code. Too many words.")
+	}
+
+	words := make([]string, len(parts)-1)
+	for i, part := range parts[1:] {
+		matches := CompleteCodeWord(part)
+		switch {
+		case part == "" || len(matches) == 0:
+			return 0, "", fmt.Errorf("Invalid code. %q is not a code word.", part)
+
+		case len(matches) == 1:
+			words[i] = matches[0]
+
+		default:
+			return 0, "", fmt.Errorf("Invalid code. %q could be %s.", part, strings.Join(matches, ", "))
+		}
+	}
+
+	return uint16(nameplate), FormatCode(uint16(nameplate), words), nil
+}
@@ -0,0 +1,104 @@
+package shared
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCodeWords(t *testing.T) {
+	if len(CodeWords) != 256 {
+		t.Errorf("%d code words, want 256 for 8 bits each", len(CodeWords))
+	}
+
+	if !sort.StringsAreSorted(CodeWords) {
+		t.Error("Code words are not sorted.")
+	}
+
+	for i := 1; i < len(CodeWords); i++ {
+		if strings.HasPrefix(CodeWords[i], CodeWords[i-1]) {
+			t.Errorf("%q is a prefix of %q", CodeWords[i-1], CodeWords[i])
+		}
+	}
+}
+
+func TestCompleteCodeWord(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"guitar", []string{"guitar"}},
+		{"gui", []string{"guitar"}},
+		{"cob", []string{"cobalt", "cobra"}},
+		{"zz", nil},
+		{"a", []string{"acorn", "adrift", "almond", "amber", "anchor", "anvil", "apricot", "arcade", "archer", "arctic", "armada", "aspen", "atlas", "autumn"}},
+		{"zinnias", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			if got := CompleteCodeWord(test.prefix); !slices.Equal(got, test.want) {
+				t.Errorf("CompleteCodeWord(%q) = %v, want %v", test.prefix, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseCode(t *testing.T) {
+	tests := []struct {
+		input         string
+		wantNameplate uint16
+		// Empty if the code is invalid.
+		wantCode string
+	}{
+		{"7-crossover-clockwork", 7, "7-crossover-clockwork"},
+		{"  7-Crossover-CLOCKWORK\n", 7, "7-crossover-clockwork"},
+		{"7-cross-clock", 7, "7-crossover-clockwork"},
+		{"65535-zebra", 65535, "65535-zebra"},
+		{"12-acorn-acorn-acorn-acorn-acorn-acorn-acorn-acorn", 12, "12-acorn-acorn-acorn-acorn-acorn-acorn-acorn-acorn"},
+		{"7", 0, ""},
+		{"crossover-clockwork", 0, ""},
+		{"0-crossover", 0, ""},
+		{"65536-crossover", 0, ""},
+		{"-7-crossover", 0, ""},
+		{"7-", 0, ""},
+		{"7-crossover-", 0, ""},
+		{"7--crossover", 0, ""},
+		{"7-notaword", 0, ""},
+		{"7-cob", 0, ""},
+		{"7-acorn-acorn-acorn-acorn-acorn-acorn-acorn-acorn-acorn", 0, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			nameplate, code, err := ParseCode(test.input)
+			if test.wantCode == "" {
+				if err == nil {
+					t.Errorf("ParseCode(%q) = %d, %q, want an error", test.input, nameplate, code)
+				}
+
+				return
+			}
+
+			if err != nil || nameplate != test.wantNameplate || code != test.wantCode {
+				t.Errorf("ParseCode(%q) = %d, %q, %v, want %d, %q", test.input, nameplate, code, err, test.wantNameplate, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestGeneratedCodeParses(t *testing.T) {
+	for count := 1; count <= MaxCodeWordCount; count++ {
+		words, err := GenerateCodeWords(count)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		code := FormatCode(42, words)
+		nameplate, parsed, err := ParseCode(code)
+		if err != nil || nameplate != 42 || parsed != code {
+			t.Errorf("ParseCode(%q) = %d, %q, %v", code, nameplate, parsed, err)
+		}
+	}
+}
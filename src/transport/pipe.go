@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frames a pipe end holds before writes block, like the socket buffers of a real connection.
+const pipeBuffer = 256
+
+// Two connected in memory transports, for running a client and the relay in one process.
+// Closing either end closes both.
+func Pipe() (Transport, Transport) {
+	aToB := make(chan []byte, pipeBuffer)
+	bToA := make(chan []byte, pipeBuffer)
+	state := &pipeState{closed: make(chan struct{})}
+
+	a := &pipeEnd{in: bToA, out: aToB, state: state, expired: make(chan struct{})}
+	b := &pipeEnd{in: aToB, out: bToA, state: state, expired: make(chan struct{})}
+	return a, b
+}
+
+type pipeState struct {
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type pipeEnd struct {
+	in    <-chan []byte
+	out   chan<- []byte
+	state *pipeState
+
+	mu sync.Mutex
+	// Closed once the read deadline passes.
+	expired chan struct{}
+	timer   *time.Timer
+}
+
+// Frames already written are still read before the close is seen.
+func (p *pipeEnd) ReadMessage() ([]byte, error) {
+	p.mu.Lock()
+	expired := p.expired
+	p.mu.Unlock()
+
+	select {
+	case frame := <-p.in:
+		return frame, nil
+	default:
+	}
+
+	select {
+	case frame := <-p.in:
+		return frame, nil
+	case <-p.state.closed:
+		return nil, net.ErrClosed
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *pipeEnd) WriteMessage(frame []byte) error {
+	select {
+	case <-p.state.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	// The caller may reuse frame.
+	select {
+	case p.out <- append([]byte(nil), frame...):
+		return nil
+	case <-p.state.closed:
+		return net.ErrClosed
+	}
+}
+
+func (p *pipeEnd) Close() error {
+	p.state.closeOnce.Do(func() { close(p.state.closed) })
+	return nil
+}
+
+func (p *pipeEnd) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+
+	expired := make(chan struct{})
+	p.expired = expired
+	if t.IsZero() {
+		return nil
+	}
+
+	p.timer = time.AfterFunc(time.Until(t), func() { close(expired) })
+	return nil
+}
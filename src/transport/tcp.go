@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Frames bigger than this are refused, so a bad length cannot make the reader allocate without end.
+const MaxFrameSize = 256 * 1024 * 1024
+
+// How long the relay waits for the query of a new TCP connection.
+const tcpHandshakeTimeout = 10 * time.Second
+
+// Frames over a raw TCP connection, each prefixed with its length as a big endian uint32.
+// The first frame a client sends is the query of the connection, which websockets send in the URL.
+type TCP struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// Length and frame go out in a single write, so a close can never cut between them.
+	mu sync.Mutex
+}
+
+func NewTCP(conn net.Conn) *TCP {
+	return &TCP{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func dialTCP(ctx context.Context, endpoint *url.URL, query url.Values) (Transport, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", endpoint.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	t := NewTCP(conn)
+	if err := t.WriteMessage([]byte(query.Encode())); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Take a connection accepted by the relay, reading the query the client sent first.
+func AcceptTCP(conn net.Conn) (*TCP, url.Values, error) {
+	t := NewTCP(conn)
+	if err := conn.SetReadDeadline(time.Now().Add(tcpHandshakeTimeout)); err != nil {
+		return nil, nil, err
+	}
+
+	frame, err := t.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query, err := url.ParseQuery(string(frame))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid query. %s", err.Error())
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+
+	return t, query, nil
+}
+
+func (t *TCP) ReadMessage() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(t.reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("Frame of %d bytes is larger than %d.", size, MaxFrameSize)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(t.reader, frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+func (t *TCP) WriteMessage(frame []byte) error {
+	if len(frame) > MaxFrameSize {
+		return fmt.Errorf("Frame of %d bytes is larger than %d.", len(frame), MaxFrameSize)
+	}
+
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, err := t.conn.Write(buf)
+	return err
+}
+
+func (t *TCP) Close() error {
+	return t.conn.Close()
+}
+
+func (t *TCP) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
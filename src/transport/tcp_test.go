@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+)
+
+// A listener on a loopback port, returning the relay end of the next connection through accepted.
+func listenTCP(t *testing.T) (net.Listener, <-chan net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+
+		accepted <- conn
+	}()
+
+	return listener, accepted
+}
+
+func TestTCPRoundTrip(t *testing.T) {
+	listener, accepted := listenTCP(t)
+
+	query := url.Values{"intent": {"receive"}, "nameplate": {"7"}}
+	client, err := Dial(context.Background(), "tcp://"+listener.Addr().String(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	relay, gotQuery, err := AcceptTCP(<-accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	if gotQuery.Encode() != query.Encode() {
+		t.Fatalf("AcceptTCP() query = %q, want %q", gotQuery.Encode(), query.Encode())
+	}
+
+	frames := [][]byte{{}, {0x02, 0x24}, bytes.Repeat([]byte("tshare"), 200_000)}
+	for _, frame := range frames {
+		if err := client.WriteMessage(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		received, err := relay.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(received, frame) {
+			t.Fatalf("relay read %d bytes, client wrote %d", len(received), len(frame))
+		}
+
+		if err := relay.WriteMessage(frame); err != nil {
+			t.Fatal(err)
+		}
+
+		received, err = client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(received, frame) {
+			t.Fatalf("client read %d bytes, relay wrote %d", len(received), len(frame))
+		}
+	}
+
+	_ = client.Close()
+	if _, err := relay.ReadMessage(); !errors.Is(err, io.EOF) {
+		t.Fatalf("ReadMessage() after close = %v, want EOF", err)
+	}
+}
+
+func TestTCPInvalidFrames(t *testing.T) {
+	header := func(size uint32) []byte {
+		return binary.BigEndian.AppendUint32(nil, size)
+	}
+
+	tests := []struct {
+		name    string
+		written []byte
+		// Cut short, rather than refused from the header alone.
+		truncated bool
+	}{
+		{"oversized", header(MaxFrameSize + 1), false},
+		{"truncated header", []byte{0, 0}, true},
+		{"truncated frame", append(header(10), 1, 2, 3), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, accepted := listenTCP(t)
+
+			raw, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+
+			conn := <-accepted
+			defer conn.Close()
+
+			if _, err := raw.Write(test.written); err != nil {
+				t.Fatal(err)
+			}
+			_ = raw.Close()
+
+			frame, err := NewTCP(conn).ReadMessage()
+			if err == nil {
+				t.Fatalf("ReadMessage() = %d bytes, want an error", len(frame))
+			}
+
+			if errors.Is(err, io.ErrUnexpectedEOF) != test.truncated {
+				t.Fatalf("ReadMessage() = %v, want truncated %v", err, test.truncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Package transport carries protocol frames between the clients and the relay.
+// The protocol only needs whole frames in order, so it can run over anything that delivers them.
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// A connection that delivers whole frames, in order.
+// One goroutine may read while another writes, but writes must not overlap.
+type Transport interface {
+	// Block until the next frame arrives.
+	ReadMessage() ([]byte, error)
+	WriteMessage(frame []byte) error
+	// Close the connection. A pending ReadMessage on either end fails.
+	Close() error
+}
+
+// Transports that can fail a pending read without closing, so the reader can still write after.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Connects to the relay at endpoint. query says who is connecting, like intent and nameplate.
+type DialFunc func(ctx context.Context, endpoint *url.URL, query url.Values) (Transport, error)
+
+// Dialers by endpoint scheme. Add one to run clients over something else,
+// like a Pipe to a relay in the same process.
+var Dialers = map[string]DialFunc{
+	"ws":  dialWebSocket,
+	"wss": dialWebSocket,
+	"tcp": dialTCP,
+}
+
+// Connect to the relay at endpoint with the dialer for its scheme.
+func Dial(ctx context.Context, endpoint string, query url.Values) (Transport, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("E:Invalid endpoint %q. %s", endpoint, err.Error())
+	}
+
+	dial, ok := Dialers[endpointURL.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("E:Invalid endpoint %q. Unknown scheme %q.", endpoint, endpointURL.Scheme)
+	}
+
+	t, err := dial(ctx, endpointURL, query)
+	if err != nil {
+		return nil, fmt.Errorf("E:Connecting to relay. %s", err.Error())
+	}
+
+	return t, nil
+}
+
+// Fail the pending and next reads on t once ctx is cancelled, so the message loop wakes up
+// and can abort the transfer itself. Writes stay with the loop. Returns what stops watching ctx.
+// Transports without read deadlines are closed instead.
+func InterruptReadsOnCancel(ctx context.Context, t Transport) func() bool {
+	return context.AfterFunc(ctx, func() {
+		if deadliner, ok := t.(readDeadliner); ok {
+			_ = deadliner.SetReadDeadline(time.Now())
+			return
+		}
+
+		_ = t.Close()
+	})
+}
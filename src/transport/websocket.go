@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frames as binary websocket messages. What the relay speaks on /api/share.
+type WebSocket struct {
+	conn *websocket.Conn
+}
+
+func NewWebSocket(conn *websocket.Conn) *WebSocket {
+	return &WebSocket{conn: conn}
+}
+
+func dialWebSocket(ctx context.Context, endpoint *url.URL, query url.Values) (Transport, error) {
+	withQuery := *endpoint
+	withQuery.RawQuery = query.Encode()
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, withQuery.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWebSocket(conn), nil
+}
+
+func (w *WebSocket) ReadMessage() ([]byte, error) {
+	_, frame, err := w.conn.ReadMessage()
+	return frame, err
+}
+
+func (w *WebSocket) WriteMessage(frame []byte) error {
+	return w.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// Send a close frame first, so the other end sees a clean close.
+func (w *WebSocket) Close() error {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = w.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	return w.conn.Close()
+}
+
+func (w *WebSocket) SetReadDeadline(t time.Time) error {
+	return w.conn.SetReadDeadline(t)
+}
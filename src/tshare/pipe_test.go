@@ -0,0 +1,230 @@
+package tshare
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apooravm/tshare-client/src/sender"
+	"github.com/apooravm/tshare-client/src/server"
+	"github.com/apooravm/tshare-client/src/shared"
+	"github.com/apooravm/tshare-client/src/transport"
+)
+
+// Connects every client to a relay in the test process, without a network.
+func dialPipe(ctx context.Context, endpoint *url.URL, query url.Values) (transport.Transport, error) {
+	client, relay := transport.Pipe()
+	go server.ServeTransport(relay, query)
+	return client, nil
+}
+
+func pipeClient(t *testing.T) *Client {
+	transport.Dialers["pipe"] = dialPipe
+	t.Cleanup(func() { delete(transport.Dialers, "pipe") })
+
+	return &Client{Endpoint: "pipe://relay"}
+}
+
+func wait(t *testing.T, transfer *Transfer) error {
+	select {
+	case <-transfer.Done():
+		return transfer.Wait()
+	case <-time.After(30 * time.Second):
+		t.Fatal("Transfer did not end.")
+		return nil
+	}
+}
+
+func TestPipeSendReceive(t *testing.T) {
+	client := pipeClient(t)
+	ctx := context.Background()
+
+	// Several chunks of data gzip cannot shrink, and text it can.
+	random := make([]byte, 3*shared.DefaultChunkSize+123)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := map[string][]byte{
+		"data/random.bin":   random,
+		"data/src/text.txt": bytes.Repeat([]byte("tshare over a pipe\n"), 2000),
+		"data/src/empty":    {},
+	}
+
+	srcDir := t.TempDir()
+	for relativePath, contents := range sent {
+		targetPath := filepath.Join(srcDir, filepath.FromSlash(relativePath))
+		if err := os.MkdirAll(filepath.Dir(targetPath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(targetPath, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send, err := client.Send(ctx, SendOptions{}, []string{filepath.Join(srcDir, "data")})
+	if err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+
+	dstDir := t.TempDir()
+	receive, err := client.Receive(ctx, send.Code(), ReceiveOptions{Dir: dstDir})
+	if err != nil {
+		t.Fatalf("Receive() = %v", err)
+	}
+
+	if err := wait(t, receive); err != nil {
+		t.Fatalf("receive Wait() = %v", err)
+	}
+
+	if err := wait(t, send); err != nil {
+		t.Fatalf("send Wait() = %v", err)
+	}
+
+	for relativePath, contents := range sent {
+		received, err := os.ReadFile(filepath.Join(dstDir, filepath.FromSlash(relativePath)))
+		if err != nil {
+			t.Errorf("%s not received. %v", relativePath, err)
+			continue
+		}
+
+		if !bytes.Equal(received, contents) {
+			t.Errorf("%s differs, received %d bytes, sent %d", relativePath, len(received), len(contents))
+		}
+	}
+}
+
+func TestPipeSendReceiveText(t *testing.T) {
+	client := pipeClient(t)
+	ctx := context.Background()
+	text := "tshare over a pipe"
+
+	send, err := client.SendText(ctx, SendOptions{}, text)
+	if err != nil {
+		t.Fatalf("SendText() = %v", err)
+	}
+
+	receive, err := client.Receive(ctx, send.Code(), ReceiveOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Receive() = %v", err)
+	}
+
+	if err := wait(t, receive); err != nil {
+		t.Fatalf("receive Wait() = %v", err)
+	}
+
+	if err := wait(t, send); err != nil {
+		t.Fatalf("send Wait() = %v", err)
+	}
+
+	if receive.Text() != text {
+		t.Errorf("Text() = %q, want %q", receive.Text(), text)
+	}
+}
+
+func TestPipeSendKeepsCause(t *testing.T) {
+	client := pipeClient(t)
+	refused := errors.New("relay refused")
+	transport.Dialers["pipe"] = func(ctx context.Context, endpoint *url.URL, query url.Values) (transport.Transport, error) {
+		return nil, refused
+	}
+
+	_, err := client.SendText(context.Background(), SendOptions{}, "never sent")
+	if !errors.Is(err, ErrIncomplete) || !strings.Contains(err.Error(), refused.Error()) {
+		t.Fatalf("SendText() = %v, want ErrIncomplete with %q", err, refused)
+	}
+}
+
+func TestPipeSendReceiveArchive(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("No unix file modes.")
+	}
+
+	var sendOutput bytes.Buffer
+	sendClient := pipeClient(t)
+	sendClient.Output = &sendOutput
+	receiveClient := &Client{Endpoint: sendClient.Endpoint}
+	ctx := context.Background()
+
+	sent := map[string]struct {
+		contents []byte
+		mode     os.FileMode
+	}{
+		"data/run.sh":          {[]byte("#!/bin/sh\necho tshare\n"), 0755},
+		"data/secret.txt":      {[]byte("only for me"), 0600},
+		"data/src/main.go":     {bytes.Repeat([]byte("package main\n"), 500), 0640},
+		"data/src/lib/empty":   {[]byte{}, 0444},
+		"data/src/lib/data.md": {[]byte("# tshare"), 0644},
+	}
+
+	srcDir := t.TempDir()
+	for relativePath, file := range sent {
+		targetPath := filepath.Join(srcDir, filepath.FromSlash(relativePath))
+		if err := os.MkdirAll(filepath.Dir(targetPath), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(targetPath, file.contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Set after writing, the umask would clear bits of the mode passed to WriteFile.
+		if err := os.Chmod(targetPath, file.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send, err := sendClient.Send(ctx, SendOptions{Archive: sender.ArchiveOn}, []string{filepath.Join(srcDir, "data")})
+	if err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+
+	dstDir := t.TempDir()
+	receive, err := receiveClient.Receive(ctx, send.Code(), ReceiveOptions{Dir: dstDir, Preserve: true})
+	if err != nil {
+		t.Fatalf("Receive() = %v", err)
+	}
+
+	if err := wait(t, receive); err != nil {
+		t.Fatalf("receive Wait() = %v", err)
+	}
+
+	if err := wait(t, send); err != nil {
+		t.Fatalf("send Wait() = %v", err)
+	}
+
+	if !strings.Contains(sendOutput.String(), "Sending the files as one archive.") {
+		t.Fatalf("Files not sent as an archive. Sender output:\n%s", sendOutput.String())
+	}
+
+	for relativePath, file := range sent {
+		targetPath := filepath.Join(dstDir, filepath.FromSlash(relativePath))
+		received, err := os.ReadFile(targetPath)
+		if err != nil {
+			t.Errorf("%s not received. %v", relativePath, err)
+			continue
+		}
+
+		if !bytes.Equal(received, file.contents) {
+			t.Errorf("%s differs, received %d bytes, sent %d", relativePath, len(received), len(file.contents))
+		}
+
+		info, err := os.Stat(targetPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode().Perm() != file.mode {
+			t.Errorf("%s has mode %v, want %v", relativePath, info.Mode().Perm(), file.mode)
+		}
+	}
+}
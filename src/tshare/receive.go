@@ -0,0 +1,119 @@
+package tshare
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/apooravm/tshare-client/src/receiver"
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+// Settings of a receive, the same as the CLI flags. Zero values are the CLI defaults.
+type ReceiveOptions struct {
+	// Folder the files are written to, created if missing. ./received if empty.
+	Dir string
+	// What to do with files that already exist, overwrite/skip/rename. There is no one to ask. -onconflict.
+	OnConflict string
+	// Files to receive, ids, ranges or globs. All if empty. -select.
+	Select string
+	// Apply the sender's file modes and mtimes, and create empty folders. -preserve.
+	Preserve bool
+	// Max chunks the sender streams ahead. -window.
+	Window uint32
+	// Codec accepted for compressed chunks, gzip or none. -compress.
+	Compress string
+	Events   Events
+}
+
+func (o *ReceiveOptions) setDefaults() error {
+	if o.Dir == "" {
+		o.Dir = "./received"
+	}
+
+	if o.OnConflict == "" {
+		o.OnConflict = receiver.ConflictOverwrite
+	}
+
+	if o.OnConflict == receiver.ConflictAsk || !slices.Contains(receiver.ConflictPolicies, o.OnConflict) {
+		return fmt.Errorf("Invalid conflict policy. Must be overwrite/skip/rename.")
+	}
+
+	if o.Window == 0 {
+		o.Window = receiver.DefaultWindow
+	}
+
+	if o.Compress == "" {
+		o.Compress = "gzip"
+	}
+
+	if _, ok := shared.CodecNames[o.Compress]; !ok {
+		return fmt.Errorf("Invalid codec. Must be gzip/none.")
+	}
+
+	return nil
+}
+
+// Receive the transfer with code into opts.Dir. Returns once it started, it goes on in the background.
+func (c *Client) Receive(ctx context.Context, code string, opts ReceiveOptions) (*Transfer, error) {
+	if strings.TrimSpace(code) == "" {
+		return nil, fmt.Errorf("No transfer code.")
+	}
+
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("E:Creating receive folder. %s", err.Error())
+	}
+
+	declined := false
+	hooks := shared.TransferEvents{
+		OnManifest: func(files []shared.FileInfo) bool {
+			if opts.Events.OnManifest == nil || opts.Events.OnManifest(toFiles(files)) {
+				return true
+			}
+
+			declined = true
+			return false
+		},
+		OnProgress: opts.Events.onProgress(),
+	}
+
+	receiverOpts := receiver.Options{
+		Endpoint:    c.endpoint(),
+		Output:      c.output(),
+		Name:        c.name("Receiver"),
+		Dir:         opts.Dir,
+		Code:        code,
+		Accept:      true,
+		Window:      opts.Window,
+		OnConflict:  opts.OnConflict,
+		Select:      opts.Select,
+		Preserve:    opts.Preserve,
+		Codecs:      shared.OfferedCodecs(opts.Compress),
+		Events:      hooks,
+		ProgressBar: progressBarOff,
+	}
+
+	return c.start(ctx, opts.Events, func(transfer *Transfer) error {
+		result, err := receiver.HandleReceiveArg(ctx, receiverOpts)
+		transfer.text = result.Text
+
+		switch {
+		case err != nil:
+			return err
+		case declined:
+			return ErrDeclined
+		case len(result.FailedVerification) != 0:
+			return fmt.Errorf("%d file(s) failed verification: %s", len(result.FailedVerification), strings.Join(result.FailedVerification, ", "))
+		case !result.Finished:
+			return ErrIncomplete
+		}
+
+		return nil
+	}), nil
+}
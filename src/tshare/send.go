@@ -0,0 +1,197 @@
+package tshare
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/apooravm/tshare-client/src/sender"
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+// Settings of a send, the same as the CLI flags. Zero values are the CLI defaults.
+type SendOptions struct {
+	// Bytes per chunk, -chunk.
+	ChunkSize uint32
+	// Words in the secret part of the code, -codewords.
+	CodeWords int
+	// Codec offered for compressing chunks, gzip or none. -compress.
+	Compress string
+	// When the files are sent as one archive, sender.ArchiveModes. -archive.
+	Archive string
+	// What to do with symlinks in a folder, shared.SymlinkPolicies. -symlinks.
+	Symlinks string
+	// Globs of files in a folder to leave out or to only send. -exclude and -include.
+	Exclude []string
+	Include []string
+	Events  Events
+}
+
+func (o *SendOptions) setDefaults() error {
+	if o.ChunkSize == 0 {
+		o.ChunkSize = shared.DefaultChunkSize
+	}
+
+	if o.CodeWords == 0 {
+		o.CodeWords = shared.DefaultCodeWordCount
+	}
+
+	if o.CodeWords < 0 || o.CodeWords > shared.MaxCodeWordCount {
+		return fmt.Errorf("Invalid code word count. Must be 1-%d.", shared.MaxCodeWordCount)
+	}
+
+	if o.Compress == "" {
+		o.Compress = "gzip"
+	}
+
+	if _, ok := shared.CodecNames[o.Compress]; !ok {
+		return fmt.Errorf("Invalid codec. Must be gzip/none.")
+	}
+
+	if o.Archive == "" {
+		o.Archive = sender.ArchiveAuto
+	}
+
+	if !slices.Contains(sender.ArchiveModes, o.Archive) {
+		return fmt.Errorf("Invalid archive mode. Must be %s.", strings.Join(sender.ArchiveModes, "/"))
+	}
+
+	if o.Symlinks == "" {
+		o.Symlinks = shared.SymlinksFollow
+	}
+
+	if !slices.Contains(shared.SymlinkPolicies, o.Symlinks) {
+		return fmt.Errorf("Invalid symlink policy. Must be %s.", strings.Join(shared.SymlinkPolicies, "/"))
+	}
+
+	for _, pattern := range append(slices.Clone(o.Exclude), o.Include...) {
+		if !shared.ValidGlob(pattern) {
+			return fmt.Errorf("Invalid glob %q.", pattern)
+		}
+	}
+
+	return nil
+}
+
+// Send files and folders. Returns once the relay issued the code, the transfer goes on in the background.
+func (c *Client) Send(ctx context.Context, opts SendOptions, paths []string) (*Transfer, error) {
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	files, err := collectFiles(paths, &opts, c.output())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.send(ctx, opts.Events, func(events shared.TransferEvents) (sender.Result, error) {
+		return sender.HandleSendArg(ctx, c.senderOptions(opts, files, events))
+	})
+}
+
+// Send a text snippet, which Receive returns from Transfer.Text. Returns once the relay issued the code.
+func (c *Client) SendText(ctx context.Context, opts SendOptions, text string) (*Transfer, error) {
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	return c.send(ctx, opts.Events, func(events shared.TransferEvents) (sender.Result, error) {
+		return sender.HandleSendTextArg(ctx, text, c.senderOptions(opts, nil, events))
+	})
+}
+
+func (c *Client) senderOptions(opts SendOptions, files []shared.FileInfo, events shared.TransferEvents) sender.Options {
+	return sender.Options{
+		Endpoint:    c.endpoint(),
+		Output:      c.output(),
+		Name:        c.name("Sender"),
+		Files:       files,
+		ChunkSize:   opts.ChunkSize,
+		CodeWords:   opts.CodeWords,
+		Codecs:      shared.OfferedCodecs(opts.Compress),
+		Archive:     opts.Archive,
+		Events:      events,
+		ProgressBar: progressBarOff,
+	}
+}
+
+// Start the send and wait for its code.
+func (c *Client) send(ctx context.Context, events Events, run func(events shared.TransferEvents) (sender.Result, error)) (*Transfer, error) {
+	issued := make(chan string, 1)
+	hooks := shared.TransferEvents{
+		OnCode: func(code string) {
+			select {
+			case issued <- code:
+			default:
+			}
+
+			if events.OnCode != nil {
+				events.OnCode(code)
+			}
+		},
+		OnProgress: events.onProgress(),
+	}
+
+	transfer := c.start(ctx, events, func(*Transfer) error {
+		result, err := run(hooks)
+		switch {
+		case err != nil && !result.Finished:
+			return fmt.Errorf("%w %w", ErrIncomplete, err)
+		case err != nil:
+			return err
+		case !result.Finished:
+			return ErrIncomplete
+		}
+
+		return nil
+	})
+
+	select {
+	case transfer.code = <-issued:
+	case <-transfer.done:
+		if transfer.err != nil {
+			return nil, transfer.err
+		}
+
+		select {
+		case transfer.code = <-issued:
+		default:
+		}
+	}
+
+	return transfer, nil
+}
+
+// File infos of all paths, numbered as one transfer.
+func collectFiles(paths []string, opts *SendOptions, out io.Writer) ([]shared.FileInfo, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No files to send.")
+	}
+
+	files := []shared.FileInfo{}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		infos, err := shared.GetAllFileInfo(path, opts.Symlinks, shared.NewFileFilter(opts.Exclude, opts.Include), out)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range *infos {
+			if seen[info.RelativePath] {
+				return nil, fmt.Errorf("%s is sent twice. Paths must have different names.", info.RelativePath)
+			}
+
+			seen[info.RelativePath] = true
+			info.Id = uint32(len(files) + 1)
+			files = append(files, info)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("Target empty.")
+	}
+
+	return files, nil
+}
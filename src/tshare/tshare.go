@@ -0,0 +1,154 @@
+// Package tshare sends and receives files and text like the tshare CLI, for programs that embed it
+// instead of running the binary.
+//
+// Every transfer keeps its own state, so a Client can run several at once.
+package tshare
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/apooravm/tshare-client/src/shared"
+)
+
+var (
+	// The transfer ended without every file arriving. What went wrong was written to Client.Output.
+	ErrIncomplete = errors.New("Transfer did not finish.")
+	// OnManifest turned the transfer down.
+	ErrDeclined = errors.New("Transfer declined.")
+)
+
+// Nothing to draw a progress bar on, progress goes to Events.OnProgress.
+var progressBarOff = shared.ProgressBarOptions{Type: "total", Length: 20, InMB: true, Off: true}
+
+type Client struct {
+	// Relay to connect to. The public one if empty.
+	Endpoint string
+	// Shown to the other side. "Sender" or "Receiver" if empty.
+	Name string
+	// Where the messages the CLI prints go. Discarded if nil.
+	Output io.Writer
+}
+
+// Callbacks for a transfer, called from the goroutine running it. Unset ones are skipped.
+type Events struct {
+	// The code to pass to Receive, once the relay issued it. Send only.
+	OnCode func(code string)
+	// The files on offer. Receive only. The transfer is declined if it returns false, accepted if unset.
+	OnManifest func(files []File) bool
+	// Bytes transferred so far out of the total. The total is 0 while it is unknown.
+	OnProgress func(transferred, total int64)
+	// The transfer ended, with what Wait returns.
+	OnDone func(err error)
+}
+
+// An entry of a transfer.
+type File struct {
+	// '/' separated. Starts with the folder name when a folder is sent.
+	Path string
+	Size int64
+	// An empty folder.
+	Dir bool
+	// A symlink, sent with Symlinks set to preserve.
+	Symlink bool
+}
+
+// A transfer running in the background.
+type Transfer struct {
+	code string
+	text string
+	err  error
+	done chan struct{}
+}
+
+// The transfer code. Empty for a received transfer.
+func (t *Transfer) Code() string {
+	return t.code
+}
+
+// The text received, once Done. Empty unless the sender sent text.
+func (t *Transfer) Text() string {
+	<-t.done
+	return t.text
+}
+
+// Closed once the transfer ended.
+func (t *Transfer) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait for the transfer to end. nil if every file arrived, or the text.
+func (t *Transfer) Wait() error {
+	<-t.done
+	return t.err
+}
+
+func (c *Client) endpoint() string {
+	if c.Endpoint == "" {
+		return shared.Endpoint
+	}
+
+	return c.Endpoint
+}
+
+func (c *Client) output() io.Writer {
+	if c.Output == nil {
+		return io.Discard
+	}
+
+	return c.Output
+}
+
+func (c *Client) name(fallback string) string {
+	if c.Name == "" {
+		return fallback
+	}
+
+	return c.Name
+}
+
+// Run the transfer in the background.
+// run returns the error of the transfer. A cancelled ctx takes precedence.
+func (c *Client) start(ctx context.Context, events Events, run func(transfer *Transfer) error) *Transfer {
+	transfer := &Transfer{done: make(chan struct{})}
+	go func() {
+		err := run(transfer)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+
+		transfer.err = err
+		close(transfer.done)
+		if events.OnDone != nil {
+			events.OnDone(err)
+		}
+	}()
+
+	return transfer
+}
+
+// Progress hook for the sender and receiver.
+func (e *Events) onProgress() func(transferred, total int) {
+	if e.OnProgress == nil {
+		return nil
+	}
+
+	return func(transferred, total int) {
+		e.OnProgress(int64(transferred), int64(total))
+	}
+}
+
+func toFiles(infos []shared.FileInfo) []File {
+	files := make([]File, len(infos))
+	for i, info := range infos {
+		files[i] = File{
+			Path:    info.RelativePath,
+			Size:    int64(info.Size),
+			Dir:     info.Type == shared.EntryTypeDir,
+			Symlink: info.Type == shared.EntryTypeSymlink,
+		}
+	}
+
+	return files
+}